@@ -163,6 +163,8 @@ func Run(args []string) (err error) {
 			pingCmd,
 			ncCmd,
 			sshCmd,
+			scpCmd,
+			sftpCmd,
 			versionCmd,
 			webCmd,
 			fileCmd,
@@ -37,7 +37,7 @@ func runNC(ctx context.Context, args []string) error {
 		return errors.New("usage: nc <hostname-or-IP> <port>")
 	}
 
-	hostOrIP, portStr := args[0], args[1]
+	hostOrIP, portStr := trimIPv6Brackets(args[0]), args[1]
 	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
 		return fmt.Errorf("invalid port number %q", portStr)
@@ -0,0 +1,191 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/envknob"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/version"
+)
+
+var scpCmd = &ffcli.Command{
+	Name:       "scp",
+	ShortUsage: "scp [-r] [[user@]host:]file ... [[user@]host:]file",
+	ShortHelp:  "Copy files to or from a Tailscale machine over SSH",
+	Exec:       runSCP,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("scp")
+		fs.BoolVar(&scpArgs.recursive, "r", false, "recursively copy entire directories")
+		return fs
+	})(),
+}
+
+var scpArgs struct {
+	recursive bool
+}
+
+func runSCP(ctx context.Context, args []string) error {
+	if runtime.GOOS == "darwin" && version.IsSandboxedMacOS() && !envknob.UseWIPCode() {
+		return errors.New("The 'tailscale scp' subcommand is not available on sandboxed macOS builds.\nUse the regular 'scp' client instead.")
+	}
+	if len(args) < 2 {
+		return errors.New("usage: scp [-r] [[user@]host:]file ... [[user@]host:]file")
+	}
+
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
+	}
+
+	scp, err := exec.LookPath("scp")
+	if err != nil {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("no system 'scp' command found: %w", err))
+	}
+	tailscaleBin, err := sshTailscaleBin()
+	if err != nil {
+		return err
+	}
+	var targets []*ipnstate.PeerStatus
+	for i, arg := range args {
+		var peer *ipnstate.PeerStatus
+		args[i], peer, err = scpArgWithPeerHost(st, arg)
+		if err != nil {
+			return err
+		}
+		if peer != nil {
+			targets = append(targets, peer)
+		}
+	}
+	knownHostsFile, err := writeKnownHosts(st, KnownHostsOptions{Targets: targets})
+	if err != nil {
+		return err
+	}
+
+	proxyCommand, err := sshProxyCommand(tailscaleBin, sshSocket())
+	if err != nil {
+		return err
+	}
+
+	argv := []string{scp}
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+		argv = append(argv, "-v")
+	}
+	argv = append(argv, sshHostOptions(knownHostsFile, proxyCommand)...)
+	if scpArgs.recursive {
+		argv = append(argv, "-r")
+	}
+	argv = append(argv, args...)
+
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+		log.Printf("Running: %q, %q ...", scp, argv)
+	}
+
+	return execSSH(scp, argv)
+}
+
+// scpArgWithPeerHost returns the scp source or destination argument
+// arg with the host part of a "[user@]host:path" remote argument
+// resolved by resolvePeer, and the peer it resolved to, if any. A
+// "user@host/path" target is rewritten to that form; see
+// scpPeerPathArg. Local paths are returned unchanged.
+func scpArgWithPeerHost(st *ipnstate.Status, arg string) (_ string, peer *ipnstate.PeerStatus, err error) {
+	userHost, path, ok := cutSCPHost(arg)
+	if !ok || userHost == "" || strings.Contains(userHost, "/") {
+		return scpPeerPathArg(st, arg)
+	}
+	if runtime.GOOS == "windows" && len(userHost) == 1 {
+		return arg, nil, nil // drive letter, as in C:\foo
+	}
+	user, host, hasUser := strings.Cut(userHost, "@")
+	if !hasUser {
+		host = userHost
+	}
+	peer, host, err = resolvePeer(st, host)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	if hasUser {
+		host = user + "@" + host
+	}
+	return host + ":" + path, peer, nil
+}
+
+// cutSCPHost cuts the scp argument arg around the colon after its
+// "[user@]host" part. A literal IPv6 host must be bracketed, as in
+// "user@[fd7a:115c:a1e0::1]:file", and keeps its brackets in userHost.
+func cutSCPHost(arg string) (userHost, path string, ok bool) {
+	hostStart := 0
+	if at := strings.Index(arg, "@["); at != -1 && !strings.ContainsAny(arg[:at], ":/") {
+		hostStart = at + 1
+	}
+	if strings.HasPrefix(arg[hostStart:], "[") {
+		if end := strings.Index(arg[hostStart:], "]:"); end != -1 {
+			end += hostStart
+			return arg[:end+1], arg[end+2:], true
+		}
+	}
+	return strings.Cut(arg, ":")
+}
+
+// cutPeerPath cuts arg, a target in the "[user@]host/path" form some
+// deployment tools use, as in "deploy@web1/var/www", around the first
+// slash. The path keeps its slash, so it's absolute. ok is false if arg
+// isn't of that form, as when it has no slash, or a colon before its
+// first slash (outside IPv6 brackets), or is an ssh:// URL.
+func cutPeerPath(arg string) (userHost, path string, ok bool) {
+	if strings.HasPrefix(arg, "ssh://") {
+		return "", "", false
+	}
+	i := strings.Index(arg, "/")
+	if i <= 0 || strings.HasSuffix(arg[:i], "@") {
+		return "", "", false
+	}
+	userHost = arg[:i]
+	if strings.Contains(userHost, ":") && !strings.HasSuffix(userHost, "]") {
+		return "", "", false
+	}
+	return userHost, arg[i:], true
+}
+
+// scpPeerPathArg returns the scp argument arg, if it's a
+// "user@host/path" target (see cutPeerPath) where host is a peer, as
+// "user@host:/path" with host resolved by resolvePeer, and the peer.
+// Anything else, as arg may just as well be a local file, is returned
+// unchanged; so is a target with no "user@", as it's indistinguishable
+// from a relative local path.
+func scpPeerPathArg(st *ipnstate.Status, arg string) (_ string, peer *ipnstate.PeerStatus, err error) {
+	userHost, path, ok := cutPeerPath(arg)
+	if !ok {
+		return arg, nil, nil
+	}
+	user, host, ok := strings.Cut(userHost, "@")
+	if !ok {
+		return arg, nil, nil
+	}
+	peer, host, err = resolvePeer(st, host)
+	if err != nil {
+		return "", nil, err
+	}
+	if peer == nil {
+		return arg, nil, nil
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	return user + "@" + host + ":" + path, peer, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestSCPArgWithPeerHost(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+			},
+		},
+	}
+	tests := []struct {
+		arg      string
+		want     string
+		wantPeer bool
+	}{
+		{"local.txt", "local.txt", false},
+		{"./a:b", "./a:b", false},
+		{"web:/tmp/x", "[fd7a:115c:a1e0::1]:/tmp/x", true},
+		{"bob@web:x", "bob@[fd7a:115c:a1e0::1]:x", true},
+		{"[fd7a:115c:a1e0::1]:/tmp/x", "[fd7a:115c:a1e0::1]:/tmp/x", true},
+		{"bob@[fd7a:115c:a1e0::1]:x", "bob@[fd7a:115c:a1e0::1]:x", true},
+		{"[fd00::9]:x", "[fd00::9]:x", false},
+		{"other.example.com:x", "other.example.com:x", false},
+		{"deploy@web/var/www", "deploy@[fd7a:115c:a1e0::1]:/var/www", true},
+		{"deploy@web.foo.ts.net/srv/app:v2", "deploy@[fd7a:115c:a1e0::1]:/srv/app:v2", true},
+		{"web/var/www", "web/var/www", false},
+		{"icon@2x/a.png", "icon@2x/a.png", false},
+	}
+	for _, tt := range tests {
+		got, ps, err := scpArgWithPeerHost(st, tt.arg)
+		if err != nil {
+			t.Errorf("scpArgWithPeerHost(%q): %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want || (ps != nil) != tt.wantPeer {
+			t.Errorf("scpArgWithPeerHost(%q) = %q, %v; want %q, peer=%v", tt.arg, got, ps != nil, tt.want, tt.wantPeer)
+		}
+	}
+}
+
+func TestCutPeerPath(t *testing.T) {
+	tests := []struct {
+		arg      string
+		userHost string
+		path     string
+		ok       bool
+	}{
+		{"deploy@web1/var/www", "deploy@web1", "/var/www", true},
+		{"web1/var/www", "web1", "/var/www", true},
+		{"bob@[fd7a:115c:a1e0::1]/x", "bob@[fd7a:115c:a1e0::1]", "/x", true},
+		{"web1", "", "", false},
+		{"/var/www", "", "", false},
+		{"deploy@/var/www", "", "", false},
+		{"web1:/var/www", "", "", false},
+		{"ssh://web1/", "", "", false},
+	}
+	for _, tt := range tests {
+		userHost, path, ok := cutPeerPath(tt.arg)
+		if userHost != tt.userHost || path != tt.path || ok != tt.ok {
+			t.Errorf("cutPeerPath(%q) = %q, %q, %v; want %q, %q, %v", tt.arg, userHost, path, ok, tt.userHost, tt.path, tt.ok)
+		}
+	}
+}
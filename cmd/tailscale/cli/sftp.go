@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/envknob"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/version"
+)
+
+var sftpCmd = &ffcli.Command{
+	Name:       "sftp",
+	ShortUsage: "sftp [-P port] [user@]host[:path]",
+	ShortHelp:  "Transfer files interactively with a Tailscale machine over SFTP",
+	Exec:       runSFTP,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("sftp")
+		fs.IntVar(&sftpArgs.port, "P", 0, "port to connect to on the remote host (default 22)")
+		return fs
+	})(),
+}
+
+var sftpArgs struct {
+	port int // 0 means the default (22)
+}
+
+func runSFTP(ctx context.Context, args []string) error {
+	if runtime.GOOS == "darwin" && version.IsSandboxedMacOS() && !envknob.UseWIPCode() {
+		return errors.New("The 'tailscale sftp' subcommand is not available on sandboxed macOS builds.\nUse the regular 'sftp' client instead.")
+	}
+	if len(args) != 1 {
+		return errors.New("usage: sftp [-P port] [user@]host[:path]")
+	}
+	if sftpArgs.port < 0 || sftpArgs.port > 65535 {
+		return fmt.Errorf("invalid port %d; must be in range 1-65535", sftpArgs.port)
+	}
+
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
+	}
+	argv, err := sftpArgv(st, args[0])
+	if err != nil {
+		return err
+	}
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+		log.Printf("Running: %q, %q ...", argv[0], argv)
+	}
+	return execSSH(argv[0], argv)
+}
+
+// sftpArgv returns the command line to run the system sftp with, to
+// connect to dest, "[user@]host[:path]" (or "[user@]host/path"; see
+// cutPeerPath, or "ssh://[user@]host[:port][/path]") with host resolved
+// as by "tailscale ssh", and the username defaulted the same way.
+func sftpArgv(st *ipnstate.Status, dest string) ([]string, error) {
+	var userHost, path string
+	var hasPath bool
+	if strings.HasPrefix(dest, "ssh://") {
+		// The URL's port has a colon too, so it's not for
+		// cutSCPHost; its path starts at the first slash.
+		userHost = dest
+		rest := strings.TrimPrefix(dest, "ssh://")
+		if i := strings.Index(rest, "/"); i != -1 {
+			userHost, path, hasPath = "ssh://"+rest[:i], rest[i:], rest[i:] != "/"
+		}
+	} else {
+		userHost, path, hasPath = cutSCPHost(dest)
+		if !hasPath || strings.Contains(userHost, "/") {
+			userHost, path, hasPath = cutPeerPath(dest)
+			if !hasPath {
+				userHost = dest
+			}
+		}
+	}
+	username, host, urlPort, err := parseSSHDestination(userHost)
+	if err != nil {
+		return nil, err
+	}
+	port := sftpArgs.port
+	if urlPort != 0 {
+		if port != 0 && port != urlPort {
+			return nil, fmt.Errorf("port %d in %q conflicts with -P %d", urlPort, dest, port)
+		}
+		port = urlPort
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1] // IPv6
+	}
+	if host == "" {
+		return nil, errors.New("usage: sftp [-P port] [user@]host[:path]")
+	}
+	peer, hostForSSH, err := resolvePeer(st, host)
+	if err != nil {
+		return nil, err
+	}
+	if peer == nil {
+		if err := sshPeerNotFoundError(st, host, false); err != nil {
+			return nil, err
+		}
+	} else if err := checkSSHPeer(peer, true); errors.Is(err, errPeerOffline) {
+		sshWarnf("%v; trying anyway.", err)
+	} else if err != nil {
+		return nil, err
+	}
+	if username, err = sshLoginName(username, "", host); err != nil {
+		return nil, err
+	}
+
+	sftp, err := exec.LookPath("sftp")
+	if err != nil {
+		return nil, withKind(ErrNoSSHBinary, fmt.Errorf("no system 'sftp' command found: %w", err))
+	}
+	tailscaleBin, err := sshTailscaleBin()
+	if err != nil {
+		return nil, err
+	}
+	proxyCommand, err := sshProxyCommand(tailscaleBin, sshSocket())
+	if err != nil {
+		return nil, err
+	}
+	knownHostsFile, err := writeKnownHosts(st, KnownHostsOptions{Targets: []*ipnstate.PeerStatus{peer}, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	argv := []string{sftp}
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+		argv = append(argv, "-v")
+	}
+	argv = append(argv, sshHostOptions(knownHostsFile, proxyCommand)...)
+	if port != 0 {
+		argv = append(argv, "-P", strconv.Itoa(port))
+	}
+	if strings.Contains(hostForSSH, ":") {
+		hostForSSH = "[" + hostForSSH + "]" // IPv6
+	}
+	target := username + "@" + hostForSSH
+	if hasPath {
+		target += ":" + path
+	}
+	return append(argv, target), nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestSFTPArgv(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("no ProxyCommand on macOS")
+	}
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", filepath.Join(t.TempDir(), "state"))
+	t.Setenv("TS_SSH_DEFAULT_USER", "admin")
+	oldRoot := rootArgs.socket
+	defer func() { rootArgs.socket = oldRoot }()
+	rootArgs.socket = "/tmp/tailscaled.sock"
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName: "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{
+					netaddr.MustParseIP("100.64.0.1"),
+					netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+				},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+
+	if _, err := sftpArgv(st, "web"); !errors.Is(err, ErrNoSSHBinary) {
+		t.Errorf("no sftp installed: got %v; want ErrNoSSHBinary", err)
+	}
+
+	name := "sftp"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	sftp := filepath.Join(binDir, name)
+	if err := os.WriteFile(sftp, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"web", "admin@100.64.0.1"},
+		{"alice@web", "alice@100.64.0.1"},
+		{"alice@web.foo.ts.net:/tmp/x", "alice@100.64.0.1:/tmp/x"},
+		{"bob@[fd7a:115c:a1e0::1]:x", "bob@100.64.0.1:x"},
+		{"deploy@web/var/www", "deploy@100.64.0.1:/var/www"},
+		{"web/srv", "admin@100.64.0.1:/srv"},
+		{"ssh://alice@web/tmp/x", "alice@100.64.0.1:/tmp/x"},
+		{"ssh://alice@web:2222/tmp/x", "alice@100.64.0.1:/tmp/x"},
+		{"ssh://web:2222", "admin@100.64.0.1"},
+	}
+	for _, tt := range tests {
+		argv, err := sftpArgv(st, tt.dest)
+		if err != nil {
+			t.Errorf("%q: %v", tt.dest, err)
+			continue
+		}
+		if argv[0] != sftp {
+			t.Errorf("%q: binary = %q; want %q", tt.dest, argv[0], sftp)
+		}
+		if got := argv[len(argv)-1]; got != tt.want {
+			t.Errorf("%q: target = %q; want %q", tt.dest, got, tt.want)
+		}
+		if _, ok := firstSSHOption(argv, "ProxyCommand"); !ok {
+			t.Errorf("%q: no ProxyCommand in %q", tt.dest, argv)
+		}
+		if kh, _ := firstSSHOption(argv, "UserKnownHostsFile"); kh == "" {
+			t.Errorf("%q: no UserKnownHostsFile in %q", tt.dest, argv)
+		}
+	}
+
+	// An ssh:// URL's port is passed on as -P would be.
+	argv, err := sftpArgv(st, "ssh://alice@web:2222/tmp/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := argv[len(argv)-3:], []string{"-P", "2222", "alice@100.64.0.1:/tmp/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with ssh:// port: argv ends %q; want %q", got, want)
+	}
+
+	oldPort := sftpArgs.port
+	defer func() { sftpArgs.port = oldPort }()
+	sftpArgs.port = 2222
+	argv, err = sftpArgv(st, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := argv[len(argv)-3:], []string{"-P", "2222", "admin@100.64.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with -P: argv ends %q; want %q", got, want)
+	}
+	if _, err := sftpArgv(st, "ssh://web:2200/tmp"); err == nil || !strings.Contains(err.Error(), "conflicts with -P 2222") {
+		t.Errorf("ssh:// port other than -P: got %v; want a conflict error", err)
+	}
+
+	// The ProxyCommand uses the same socket as "tailscale ssh".
+	oldSocket := sshArgs.socket
+	defer func() { sshArgs.socket = oldSocket }()
+	sshArgs.socket = "/tmp/other.sock"
+	if argv, err = sftpArgv(st, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if pc, _ := firstSSHOption(argv, "ProxyCommand"); !strings.Contains(pc, "/tmp/other.sock") {
+		t.Errorf("with sshArgs.socket set, ProxyCommand = %q; want it to use /tmp/other.sock", pc)
+	}
+	sshArgs.socket = ""
+
+	if _, err := sftpArgv(st, "webx"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("typo of a peer name: got %v; want ErrPeerNotFound", err)
+	}
+}
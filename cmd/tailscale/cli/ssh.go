@@ -7,99 +7,615 @@
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	shellquote "github.com/kballard/go-shellquote"
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/key"
 	"tailscale.com/version"
 )
 
 var sshCmd = &ffcli.Command{
 	Name:       "ssh",
-	ShortUsage: "ssh [user@]<host> [args...]",
+	ShortUsage: "ssh [flags] [user@]<host> [args...]",
 	ShortHelp:  "SSH to a Tailscale machine",
-	Exec:       runSSH,
+	LongHelp: strings.TrimSpace(`
+The 'tailscale ssh' command runs the system ssh (or a built-in client, if
+there's none) to connect to a Tailscale machine, verifying its host key
+against the one tailscaled knows for it.
+
+The host can be a peer's MagicDNS name (full or short) or Tailscale IP, or,
+for scripts that shouldn't break when a peer is renamed, nodeid:<stable ID>
+or its node key, nodekey:<hex>.
+
+Once ssh runs, its exit code is passed through: the remote command's, or 255
+if ssh itself fails. If 'tailscale ssh' fails before running ssh, it exits
+with:
+
+  3  the host isn't a peer in the tailnet
+  4  the peer doesn't run Tailscale SSH
+  5  tailscaled couldn't be reached
+  6  the system ssh is needed but isn't installed
+  1  any other error
+`),
+	Exec: runSSH,
+	FlagSet: (func() *flag.FlagSet {
+		fs := newFlagSet("ssh")
+		fs.StringVar(&sshArgs.loginName, "l", "", "user to log in as on the remote host; alternative to user@host")
+		fs.StringVar(&sshArgs.loginName, "login-name", "", "alias for -l")
+		fs.StringVar(&sshArgs.userMap, "user-map", "", `JSON file of default usernames per host, used when no user is given, as in [{"Host": "router-*", "User": "root"}]; the first matching Host pattern wins (default: ssh_users.json in the --known-hosts-dir directory, if it exists)`)
+		fs.Var(&sshArgs.identities, "i", "path to a private key to authenticate with; may be repeated")
+		fs.Var(&sshArgs.identities, "identity", "alias for -i")
+		fs.BoolVar(&sshArgs.ipv4, "4", false, "connect to peers by their Tailscale IPv4 address only")
+		fs.BoolVar(&sshArgs.ipv6, "6", false, "connect to peers by their Tailscale IPv6 address only")
+		fs.BoolVar(&sshArgs.noResolve, "no-resolve", false, "pass the host to ssh as given, for your own DNS or hosts file to resolve, rather than as the peer's Tailscale IP; the known_hosts file and ProxyCommand are still set up")
+		fs.StringVar(&sshArgs.bindAddress, "bind-address", "", "local IP address for ssh's connection to come from, as for ssh -b; only matters where ssh connects directly rather than via tailscaled (as on macOS)")
+		fs.IntVar(&sshArgs.port, "p", 0, "port to connect to on the remote host (default 22)")
+		fs.IntVar(&sshArgs.port, "port", 0, "alias for -p")
+		fs.StringVar(&sshArgs.jump, "J", "", "connect via the given [user@]host jump host, resolved like the target")
+		fs.StringVar(&sshArgs.jump, "jump", "", "alias for -J")
+		fs.DurationVar(&sshArgs.jumpTimeout, "jump-timeout", 0, "with --jump, give up connecting to the jump host after this long, separately from --timeout for the target; 0 means ssh's default")
+		fs.Var(&sshArgs.localForwards, "L", "forward local [bind:]port to host:hostport, as seen from the remote host; host may be a tailnet peer name. May be repeated")
+		fs.Var(&sshArgs.remoteForwards, "R", "forward remote [bind:]port to host:hostport, as seen from this machine; host may be a tailnet peer name. May be repeated")
+		fs.BoolVar(&sshArgs.tty, "t", false, "force allocating a terminal on the remote host, even when running a command")
+		fs.BoolVar(&sshArgs.tty, "tty", false, "alias for -t")
+		fs.BoolVar(&sshArgs.noTTY, "T", false, "don't allocate a terminal on the remote host")
+		fs.BoolVar(&sshArgs.noTTY, "no-tty", false, "alias for -T")
+		fs.StringVar(&sshArgs.escapeChar, "escape-char", "", `escape character for the session, as for ssh -e: a single character, ^ and a letter for a control character, or "none" to disable escapes (default: ssh's, ~)`)
+		fs.BoolVar(&sshArgs.forwardAgent, "A", false, "forward the local ssh-agent to the remote host. Anyone with root there can then use your agent's keys while you're connected; only use it with hosts you trust")
+		fs.BoolVar(&sshArgs.forwardAgent, "forward-agent", false, "alias for -A")
+		fs.Var(&sshArgs.verbose, "v", "verbose: log the resolved host, known_hosts file, and ssh command, and pass -v to ssh; repeat for more ssh verbosity")
+		fs.Var(&sshArgs.verbose, "verbose", "alias for -v")
+		fs.BoolVar(&sshArgs.quiet, "q", false, "quiet: print no warnings or other informational messages, and pass -q to ssh; errors are still printed")
+		fs.BoolVar(&sshArgs.quiet, "quiet", false, "alias for -q")
+		fs.StringVar(&sshArgs.tailscaleBin, "tailscale-bin", "", "path to the tailscale binary for ssh to run as its ProxyCommand (default: this binary, or $TS_SSH_TAILSCALE_BIN)")
+		fs.StringVar(&sshArgs.socket, "socket", "", "path to the tailscaled socket to use for this connection, overriding tailscale's own --socket")
+		fs.DurationVar(&sshArgs.timeout, "timeout", 0, "give up connecting after this long; 0 means ssh's default, or 10s if the peer appears offline")
+		fs.Var(&sshArgs.options, "o", "OpenSSH option to pass to ssh, as Key=value; only "+strings.Join(allowedSSHOptions, ", ")+" are allowed, and they override the options tailscale sets itself. May be repeated")
+		fs.Var(&sshArgs.options, "option", "alias for -o")
+		fs.BoolVar(&sshArgs.batch, "batch", false, "never prompt (for passwords, passphrases or unknown host keys); fail instead. For scripts")
+		fs.BoolVar(&sshArgs.compression, "compression", false, "compress the connection (default: only when it's relayed via DERP)")
+		fs.BoolVar(&sshArgs.noCompression, "no-compression", false, "don't compress the connection, even when it's relayed via DERP")
+		fs.BoolVar(&sshArgs.keepalive, "keepalive", false, "send keepalives every 15s, and give up after 3 unanswered, so an idle session isn't silently dropped (default: only when it's relayed via DERP)")
+		fs.BoolVar(&sshArgs.noKeepalive, "no-keepalive", false, "don't send keepalives, even when the connection is relayed via DERP")
+		fs.BoolVar(&sshArgs.mux, "mux", false, "share one connection per user, host and port among concurrent sessions (default: $TS_SSH_MUX). The shared connection stays open for 60s after its last session ends, then exits and removes its socket")
+		fs.BoolVar(&sshArgs.noMux, "no-mux", false, "don't share connections, even if $TS_SSH_MUX is set")
+		fs.Var(&sshArgs.sendEnv, "send-env", "name (or OpenSSH pattern, like LC_*) of a local environment variable to send to the remote session, in addition to TERM, LANG and LC_*; may be repeated")
+		fs.BoolVar(&sshArgs.noSendEnv, "no-send-env", false, "don't send any local environment variables to the remote session by default")
+		fs.StringVar(&sshArgs.wrap, "wrap", "", "command to run the remote command under, like 'sudo -i': it's prepended, with each remote command arg quoted so it reaches the wrapper as one argument, so 'tailscale ssh --wrap \"sudo -i\" web cmd' runs 'sudo -i cmd'. With no remote command, it's run as the interactive session")
+		fs.StringVar(&sshArgs.localCommand, "local-command", "", "shell command to run on this (the local) machine once connected, with ssh's tokens such as %r (remote user) and %h (host) expanded; see LocalCommand in ssh_config(5)")
+		fs.BoolVar(&sshArgs.noSSHConfig, "no-ssh-config", false, "don't read ~/.ssh/config or the system ssh_config, so only this command's options apply (by default they're read, and can change how ssh connects to peers)")
+		fs.StringVar(&sshArgs.hostKeyAlgos, "hostkey-algos", "", "comma-separated host key algorithms ssh should accept, in order of preference, like ssh-ed25519,ecdsa-sha2-nistp256; see HostKeyAlgorithms in ssh_config(5)")
+		fs.BoolVar(&sshArgs.noKnownHosts, "no-known-hosts", false, "don't generate a known_hosts file of peers' host keys from Tailscale; use ssh's default host key store instead. You then verify new hosts' keys yourself on first use, instead of trusting the keys Tailscale distributes")
+		sshArgs.knownHostsMode = 0644
+		fs.Var(&sshArgs.knownHostsMode, "known-hosts-mode", "octal permissions for the generated known_hosts file, applied whenever it's written, such as 0600 to keep it private to you")
+		fs.StringVar(&sshArgs.knownHostsDir, "known-hosts-dir", "", "directory to write the generated known_hosts file (and other state) in (default: $TS_SSH_KNOWN_HOSTS_DIR, or tailscale in the user config directory)")
+		fs.BoolVar(&sshArgs.acceptNewHostKeys, "accept-new-hostkeys", false, "trust on first use the host key of a peer whose keys Tailscale hasn't distributed yet, as for a brand-new machine, instead of refusing to connect; a changed key is still rejected")
+		fs.BoolVar(&sshArgs.includeOffline, "include-offline", false, "include offline peers' host keys in the generated known_hosts file, not just online peers and the target")
+		fs.BoolVar(&sshArgs.omitShortNames, "omit-short-names", false, "list peers in the generated known_hosts file under their full MagicDNS names and IPs only, not also their short names (like web for web.foo.ts.net), which can collide between peers. It uses a known_hosts file of its own, ssh_known_hosts_fqdn, so runs without it are unaffected")
+		fs.BoolVar(&sshArgs.hashKnownHosts, "hash-known-hosts", false, "hash host names and IPs in the generated known_hosts file, like OpenSSH's HashKnownHosts. It uses a known_hosts file of its own, ssh_known_hosts_hashed, so runs without it are unaffected")
+		fs.BoolVar(&sshArgs.timings, "timings", false, "print to stderr how long each phase of setting up the connection took, before handing off to ssh")
+		fs.BoolVar(&sshArgs.jsonEvents, "json-events", false, "print connection progress to stderr as newline-delimited JSON events, for wrappers: resolved, known_hosts_written and connecting, then connected and exited with the built-in client only, as the system ssh replaces this process")
+		fs.BoolVar(&sshArgs.complete, "complete", false, "print the peer names completing the given partial [user@]host, for shell completion, instead of connecting")
+		fs.BoolVar(&sshArgs.copyID, "copy-id", false, "install your public keys (those of the -i keys, or else ~/.ssh/id_*.pub) in the remote user's ~/.ssh/authorized_keys, like ssh-copy-id, instead of starting a session; keys already there aren't added again")
+		fs.BoolVar(&sshArgs.expandEnv, "expand-env", false, "expand $VAR and ${VAR} environment variable references in the host argument, for scripts that pass it unexpanded, as in: tailscale ssh --expand-env '${TS_HOST}'")
+		fs.BoolVar(&sshArgs.self, "self", false, "connect to this node, to test that its Tailscale SSH server works; any arguments are the remote command")
+		fs.BoolVar(&sshArgs.check, "check", false, "resolve the host, write known_hosts and print the ssh command that would be run, without connecting; fails if the host isn't a usable peer")
+		fs.BoolVar(&sshArgs.check, "dry-run", false, "alias for --check")
+		fs.BoolVar(&sshArgs.printConfig, "print-config", false, "print an OpenSSH config block for ~/.ssh/config that lets plain ssh reach peers the way this command does; regenerate it after upgrading tailscale")
+		fs.BoolVar(&sshArgs.dumpKnownHosts, "print-known-hosts", false, "print the known_hosts file of peers' host keys that connecting would generate (honoring --include-offline, --hash-known-hosts, --omit-short-names, -4 and -6), instead of connecting or writing it")
+		fs.BoolVar(&sshArgs.resolve, "resolve", false, "print the peer the host resolves to, its Tailscale IPs, whether it's online and how many SSH host keys it has, instead of connecting; fails if the host isn't a peer. A glob pattern like 'web-*' prints each peer it matches")
+		fs.BoolVar(&sshArgs.genConfig, "generate-config", false, "generate an ssh_config file for ~/.ssh/config to Include, with a Host block for each peer running Tailscale SSH, so plain 'ssh <peer>' works; written to the file given as an argument (atomically), or else printed")
+		fs.BoolVar(&sshArgs.list, "list", false, "list the peers that have Tailscale SSH enabled, instead of connecting; an argument, a glob pattern like 'web-*', lists only the peers whose short or full MagicDNS name it matches")
+		fs.BoolVar(&sshArgs.json, "json", false, "with --list, output in JSON format")
+		fs.BoolVar(&sshArgs.recent, "recent", false, "list the hosts recently connected to, most recent first, instead of connecting")
+		fs.BoolVar(&sshArgs.noHistory, "no-history", false, "don't add this connection's host to the recent-hosts history that --recent lists")
+		return fs
+	})(),
+}
+
+var sshArgs struct {
+	loginName    string
+	userMap      string // if non-empty, overrides sshUserMapFile's default
+	identities   stringsFlag
+	port         int // 0 means the default (22)
+	bindAddress  string
+	ipv4         bool
+	ipv6         bool
+	noResolve    bool
+	jump         string
+	jumpTimeout  time.Duration // connect timeout for the jump host; 0 means the default
+	verbose      countFlag
+	quiet        bool
+	socket       string        // if non-empty, overrides rootArgs.socket
+	tailscaleBin string        // if non-empty, overrides os.Executable for the ProxyCommand
+	timeout      time.Duration // connect timeout; 0 means the default
+
+	forwardAgent   bool
+	localForwards  stringsFlag // -L specs
+	remoteForwards stringsFlag // -R specs
+
+	options       stringsFlag // -o Key=value
+	tty           bool        // -t: RequestTTY force
+	noTTY         bool        // -T: RequestTTY no
+	escapeChar    string      // -e; "" means ssh's default
+	batch         bool
+	compression   bool
+	noCompression bool
+	keepalive     bool
+	noKeepalive   bool
+	mux           bool
+	noMux         bool
+	sendEnv       stringsFlag
+	noSendEnv     bool
+	wrap          string // prefix for the remote command
+	localCommand  string
+	noSSHConfig   bool
+
+	complete    bool
+	expandEnv   bool
+	copyID      bool
+	check       bool // --check or --dry-run
+	self        bool
+	list        bool
+	resolve     bool
+	printConfig bool
+	genConfig   bool
+	json        bool // JSON output for list
+	recent      bool
+	noHistory   bool
+	timings     bool
+	jsonEvents  bool
+
+	noKnownHosts   bool
+	knownHostsDir  string       // if non-empty, overrides sshStateDir's default
+	knownHostsMode fileModeFlag // 0 means 0644
+	includeOffline bool
+	omitShortNames bool
+	hashKnownHosts bool
+	dumpKnownHosts bool // --print-known-hosts
+
+	acceptNewHostKeys bool
+	hostKeyAlgos      string
+}
+
+// stringsFlag is a flag.Value for flags that may be repeated,
+// accumulating each value in order.
+type stringsFlag []string
+
+func (v *stringsFlag) String() string { return strings.Join(*v, ",") }
+
+func (v *stringsFlag) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+// countFlag is a flag.Value for a boolean flag that may be repeated,
+// like ssh's -v, counting its occurrences.
+type countFlag int
+
+func (v *countFlag) IsBoolFlag() bool { return true }
+
+func (v *countFlag) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *countFlag) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if b {
+		*v++
+	} else {
+		*v = 0
+	}
+	return nil
+}
+
+// fileModeFlag is a flag.Value for the permissions of a file that
+// only its owner may write, in octal, as for chmod.
+type fileModeFlag os.FileMode
+
+func (v *fileModeFlag) String() string { return fmt.Sprintf("%#o", os.FileMode(*v)) }
+
+func (v *fileModeFlag) Set(s string) error {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return fmt.Errorf("%q is not an octal file permission, like 0600", s)
+	}
+	if m&0400 == 0 {
+		return fmt.Errorf("mode %#o doesn't let you read the file", m)
+	}
+	if m&0022 != 0 {
+		return fmt.Errorf("mode %#o lets other users write the file", m)
+	}
+	*v = fileModeFlag(m)
+	return nil
 }
 
 func runSSH(ctx context.Context, args []string) error {
 	if runtime.GOOS == "darwin" && version.IsSandboxedMacOS() && !envknob.UseWIPCode() {
 		return errors.New("The 'tailscale ssh' subcommand is not available on sandboxed macOS builds.\nUse the regular 'ssh' client instead.")
 	}
-	if len(args) == 0 {
+	if sshArgs.socket != "" {
+		localClient.Socket = sshArgs.socket
+		localClient.UseSocketOnly = true
+	}
+	if sshArgs.complete {
+		var partial string
+		if len(args) > 0 {
+			partial = args[0]
+		}
+		return runSSHComplete(ctx, partial)
+	}
+	if sshArgs.list {
+		var pattern string
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		return runSSHList(ctx, pattern)
+	}
+	if sshArgs.recent {
+		return runSSHRecent()
+	}
+	if sshArgs.printConfig {
+		return runSSHPrintConfig(ctx)
+	}
+	if sshArgs.dumpKnownHosts {
+		return runSSHPrintKnownHosts(ctx)
+	}
+	if sshArgs.genConfig {
+		return runSSHGenerateConfig(ctx, args)
+	}
+	if sshArgs.resolve {
+		if sshArgs.self {
+			return errors.New("--resolve and --self are mutually exclusive")
+		}
+		if len(args) != 1 {
+			return errors.New("usage: ssh --resolve [user@]<host>")
+		}
+		return runSSHResolve(ctx, args[0])
+	}
+	if len(args) == 0 && !sshArgs.self {
 		return errors.New("usage: ssh [user@]<host>")
 	}
-	arg, argRest := args[0], args[1:]
-	username, host, ok := strings.Cut(arg, "@")
-	if !ok {
-		host = arg
-		lu, err := user.Current()
+	if sshArgs.port < 0 || sshArgs.port > 65535 {
+		return fmt.Errorf("invalid port %d; must be in range 1-65535", sshArgs.port)
+	}
+	for _, f := range sshArgs.identities {
+		if _, err := os.Stat(f); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("identity file %q does not exist", f)
+			}
+			return fmt.Errorf("identity file: %w", err)
+		}
+	}
+	for _, name := range sshArgs.sendEnv {
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			return fmt.Errorf("invalid --send-env name %q", name)
+		}
+	}
+	// Checked again by buildSSHCommand, but fail before connecting
+	// to tailscaled.
+	if _, err := sshUserOptions(sshArgs.options); err != nil {
+		return err
+	}
+	if _, err := sshHostKeyAlgosOptions(sshArgs.hostKeyAlgos); err != nil {
+		return err
+	}
+	if _, err := sshBindAddressFlags(sshArgs.bindAddress); err != nil {
+		return err
+	}
+	if _, err := sshEscapeCharFlags(sshArgs.escapeChar); err != nil {
+		return err
+	}
+	if sshArgs.jumpTimeout != 0 && sshArgs.jump == "" {
+		return errors.New("--jump-timeout requires --jump")
+	}
+	if sshArgs.quiet && sshArgs.verbose > 0 {
+		return errors.New("--quiet and --verbose are mutually exclusive")
+	}
+	if sshArgs.ipv4 && sshArgs.ipv6 {
+		return errors.New("-4 and -6 are mutually exclusive")
+	}
+	if sshArgs.tty && sshArgs.noTTY {
+		return errors.New("--tty and --no-tty are mutually exclusive")
+	}
+	if sshArgs.compression && sshArgs.noCompression {
+		return errors.New("--compression and --no-compression are mutually exclusive")
+	}
+	if sshArgs.keepalive && sshArgs.noKeepalive {
+		return errors.New("--keepalive and --no-keepalive are mutually exclusive")
+	}
+	if sshArgs.mux && sshArgs.noMux {
+		return errors.New("--mux and --no-mux are mutually exclusive")
+	}
+	if sshArgs.mux && runtime.GOOS == "windows" {
+		return errors.New("--mux is not supported on Windows")
+	}
+	if strings.ContainsAny(sshArgs.localCommand, "\r\n") {
+		return errors.New("--local-command must be a single line")
+	}
+	if strings.ContainsAny(sshArgs.wrap, "\r\n") {
+		return errors.New("--wrap must be a single line")
+	}
+	if sshArgs.wrap != "" && sshArgs.copyID {
+		return errors.New("--wrap and --copy-id are mutually exclusive")
+	}
+	// With --self, there's no host argument; the args are all the
+	// remote command.
+	var dest, username, host string
+	var err error
+	argRest := args
+	if !sshArgs.self {
+		argRest = args[1:]
+		dest = args[0]
+		if dest == "-" {
+			if dest, err = readSSHDestination(sshStdin); err != nil {
+				return err
+			}
+		}
+		if dest, err = sshExpandEnv(dest); err != nil {
+			return err
+		}
+		var urlPort int
+		username, host, urlPort, err = parseSSHDestination(dest)
 		if err != nil {
-			return nil
+			return err
+		}
+		if urlPort != 0 {
+			if sshArgs.port != 0 && sshArgs.port != urlPort {
+				return fmt.Errorf("port %d in %q conflicts with --port=%d", urlPort, dest, sshArgs.port)
+			}
+			sshArgs.port = urlPort
 		}
-		username = lu.Username
 	}
-
-	st, err := localClient.Status(ctx)
+	argRest = sshRemoteCommandArgs(argRest)
+	host = sshHostWithoutPath(host, argRest)
+	if sshArgs.copyID {
+		if len(argRest) > 0 {
+			return errors.New("--copy-id doesn't take a remote command")
+		}
+		copyIDCommand, err := sshCopyIDCommand(sshArgs.identities)
+		if err != nil {
+			return err
+		}
+		argRest = []string{copyIDCommand}
+	}
+	username, err = sshLoginName(username, sshArgs.loginName, host)
 	if err != nil {
 		return err
 	}
 
-	// hostForSSH is the hostname we'll tell OpenSSH we're
-	// connecting to, so we have to maintain fewer entries in the
-	// known_hosts files.
-	hostForSSH := host
-	if v, ok := nodeDNSNameFromArg(st, host); ok {
-		hostForSSH = v
+	var timings sshTimings
+	phaseStart := time.Now()
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
 	}
+	timings.add("status fetch", phaseStart)
 
+	opts := sshBuildOptions{
+		Status:        st,
+		Username:      username,
+		Host:          host,
+		RemoteCommand: argRest,
+		timings:       &timings,
+	}
 	ssh, err := exec.LookPath("ssh")
 	if err != nil {
-		// TODO(bradfitz): use Go's crypto/ssh client instead
-		// of failing. But for now:
-		return fmt.Errorf("no system 'ssh' command found: %w", err)
+		// No system ssh; fall back to Go's SSH client.
+		if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+			log.Printf("no system 'ssh' command found (%v); using built-in client", err)
+		}
+		if err := checkNativeSSHFlags(err); err != nil {
+			return err
+		}
+		t, err := resolveSSHTarget(opts)
+		if err != nil {
+			return err
+		}
+		if sshArgs.check {
+			printSSHCheck(t, nil)
+			return nil
+		}
+		if sshArgs.timings && !sshArgs.quiet {
+			timings.add("exec handoff", t.resolvedAt)
+			timings.print(Stderr)
+		}
+		emitSSHEvent(sshEvent{Event: "connecting", Addr: t.hostForSSH})
+		return runSSHNative(ctx, username, t, dest, sshWrapCommand(sshArgs.wrap, argRest))
 	}
-	tailscaleBin, err := os.Executable()
+	opts.SSH = ssh
+	argv, t, err := buildSSHCommand(opts)
 	if err != nil {
 		return err
 	}
-	knownHostsFile, err := writeKnownHosts(st)
-	if err != nil {
+
+	if sshArgs.check {
+		printSSHCheck(t, argv)
+		return nil
+	}
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") || sshArgs.verbose > 0 {
+		log.Printf("Running: %q, %q ...", ssh, argv)
+	}
+	if sshArgs.timings && !sshArgs.quiet {
+		// Now, as execSSH replaces this process.
+		timings.add("exec handoff", t.resolvedAt)
+		timings.print(Stderr)
+	}
+	emitSSHEvent(sshEvent{Event: "connecting", Addr: t.hostForSSH})
+	if sshExecReplacesProcess {
+		// There's no after, so there's no knowing whether ssh
+		// connects: the host is recorded once it resolves to a
+		// usable target, even if ssh then fails to log in.
+		recordSSHHistory(dest)
+	}
+	if err := execSSH(ssh, argv); err != nil {
 		return err
 	}
+	// Where ssh runs as a child, execSSH only returns once it has
+	// exited 0.
+	recordSSHHistory(dest)
+	return nil
+}
 
-	argv := []string{ssh}
+// sshBuildOptions are the inputs to buildSSHArgs, beyond the flags in
+// sshArgs.
+type sshBuildOptions struct {
+	// Status is tailscaled's status, to resolve Host in. If nil,
+	// buildSSHArgs fetches it.
+	Status *ipnstate.Status
 
-	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
-		argv = append(argv, "-vvv")
+	Username      string   // to log in as; required
+	Host          string   // the host argument, without "user@"; unused with --self
+	RemoteCommand []string // the args after the host, without a leading "--"
+
+	// SSH is the path to the system ssh binary. If empty,
+	// buildSSHArgs looks for it in $PATH.
+	SSH string
+
+	timings *sshTimings // if non-nil, records the phases for --timings
+}
+
+// buildSSHArgs returns the command line that "tailscale ssh" runs the
+// system ssh with, for the connection described by opts and sshArgs,
+// without running it: it resolves the host, writes the known_hosts
+// file of peers' host keys (unless --no-known-hosts) and builds the
+// ssh options, including the ProxyCommand via tailscaled.
+//
+// The caller must call cleanup once done with argv, whether or not it
+// ran it. It removes what buildSSHArgs created for this command alone;
+// that's nothing today, as the known_hosts file is shared by all
+// connections and kept up to date, but may not always be.
+func buildSSHArgs(ctx context.Context, opts sshBuildOptions) (argv []string, cleanup func(), err error) {
+	cleanup = func() {}
+	if opts.Status == nil {
+		if opts.Status, err = sshStatus(ctx); err != nil {
+			return nil, cleanup, sshStatusError(err)
+		}
 	}
-	argv = append(argv,
-		// Only trust SSH hosts that we know about.
-		"-o", fmt.Sprintf("UserKnownHostsFile %q", knownHostsFile),
-		"-o", "UpdateHostKeys no",
-		"-o", "StrictHostKeyChecking yes",
-	)
+	if opts.SSH == "" {
+		if opts.SSH, err = exec.LookPath("ssh"); err != nil {
+			return nil, cleanup, withKind(ErrNoSSHBinary, fmt.Errorf("no system 'ssh' command found: %w", err))
+		}
+	}
+	argv, _, err = buildSSHCommand(opts)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	return argv, cleanup, nil
+}
 
-	// TODO(bradfitz): nc is currently broken on macOS:
-	// https://github.com/tailscale/tailscale/issues/4529
-	// So don't use it for now. MagicDNS is usually working on macOS anyway
-	// and they're not in userspace mode, so 'nc' isn't very useful.
-	if runtime.GOOS != "darwin" {
-		argv = append(argv,
-			"-o", fmt.Sprintf("ProxyCommand %q --socket=%q nc %%h %%p",
-				tailscaleBin,
-				rootArgs.socket,
-			))
+// sshTarget is what resolveSSHTarget resolved a connection's host to.
+type sshTarget struct {
+	hostForSSH     string               // what ssh connects to; see resolveSSHTarget
+	peer           *ipnstate.PeerStatus // nil if the host isn't a peer
+	router         *ipnstate.PeerStatus // if not a peer, the subnet router the host is reached through, if any
+	jumpHost       string               // for --jump, the resolved "[user@]host"; else empty
+	knownHostsFile string               // empty if ssh should use its defaults
+	connectTimeout time.Duration        // 0 means ssh's default
+	resolvedAt     time.Time            // when resolution ended, for --timings
+}
+
+// buildSSHCommand is buildSSHArgs, with opts.Status and opts.SSH set,
+// that also returns what the host resolved to.
+func buildSSHCommand(opts sshBuildOptions) ([]string, *sshTarget, error) {
+	t, err := resolveSSHTarget(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	userOptions, err := sshUserOptions(sshArgs.options)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeyAlgosOptions, err := sshHostKeyAlgosOptions(sshArgs.hostKeyAlgos)
+	if err != nil {
+		return nil, nil, err
+	}
+	bindFlags, err := sshBindAddressFlags(sshArgs.bindAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	escapeFlags, err := sshEscapeCharFlags(sshArgs.escapeChar)
+	if err != nil {
+		return nil, nil, err
+	}
+	tailscaleBin, err := sshTailscaleBin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	argv := []string{opts.SSH}
+
+	argv = append(argv, sshVerbosityFlags()...)
+	if f := sshIPFamily(); f != 0 {
+		argv = append(argv, fmt.Sprintf("-%d", f))
+	}
+	argv = append(argv, sshConfigFileOptions()...)
+	argv = append(argv, bindFlags...)
+	proxyCommand, err := sshProxyCommand(tailscaleBin, sshSocket())
+	if err != nil {
+		return nil, nil, err
+	}
+	if t.jumpHost != "" {
+		proxyCommand = sshJumpProxyCommand(opts.SSH, t.jumpHost, t.knownHostsFile, proxyCommand)
+	}
+	argv = append(argv, sshHostOptionsWithUser(userOptions, t.knownHostsFile, proxyCommand)...)
+	argv = append(argv, sshIdentityOptions()...)
+	argv = append(argv, sshSendEnvOptions()...)
+	argv = append(argv, sshConnectTimeoutOptions(t.connectTimeout)...)
+	argv = append(argv, sshTTYOptions()...)
+	argv = append(argv, sshConsoleTTYOptions(opts.RemoteCommand)...)
+	argv = append(argv, sshWrapTTYOptions(opts.RemoteCommand)...)
+	argv = append(argv, escapeFlags...)
+	argv = append(argv, sshBatchOptions()...)
+	argv = append(argv, sshCompressionOptions(t.peer)...)
+	argv = append(argv, sshKeepaliveOptions(t.peer)...)
+	argv = append(argv, sshLocalCommandOptions(sshArgs.localCommand)...)
+	argv = append(argv, hostKeyAlgosOptions...)
+	if sshMuxEnabled() {
+		muxOpts, err := sshMuxOptions()
+		if err != nil {
+			return nil, nil, err
+		}
+		argv = append(argv, muxOpts...)
+	}
+	if sshArgs.forwardAgent {
+		argv = append(argv, "-o", "ForwardAgent yes")
+	}
+	forwardArgs, err := sshForwardArgs(opts.Status)
+	if err != nil {
+		return nil, nil, err
+	}
+	argv = append(argv, forwardArgs...)
+	if sshArgs.port != 0 {
+		// Also used by the ProxyCommand's %p.
+		argv = append(argv, "-p", strconv.Itoa(sshArgs.port))
 	}
 
 	// Explicitly rebuild the user@host argument rather than
@@ -112,77 +628,1872 @@ func runSSH(ctx context.Context, args []string) error {
 	// to use a different one, we'll later be making stock ssh
 	// work well by default too. (doing things like automatically
 	// setting known_hosts, etc)
-	argv = append(argv, username+"@"+hostForSSH)
-
-	argv = append(argv, argRest...)
+	argv = append(argv, opts.Username+"@"+t.hostForSSH)
 
-	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
-		log.Printf("Running: %q, %q ...", ssh, argv)
+	if remoteCommand := sshWrapCommand(sshArgs.wrap, opts.RemoteCommand); len(remoteCommand) > 0 {
+		// ssh takes args after the host that start with "-" as
+		// its own flags; "--" makes them all the remote command.
+		argv = append(argv, "--")
+		argv = append(argv, remoteCommand...)
 	}
-
-	return execSSH(ssh, argv)
+	return argv, t, nil
 }
 
-func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
-	confDir, err := os.UserConfigDir()
-	if err != nil {
-		return "", err
+// resolveSSHTarget resolves opts.Host (or with --self, this node) and
+// the --jump host, if any, in opts.Status, checks that they're usable,
+// and writes the known_hosts file for them.
+func resolveSSHTarget(opts sshBuildOptions) (*sshTarget, error) {
+	st, host := opts.Status, opts.Host
+
+	// hostForSSH is the host we'll tell OpenSSH we're connecting
+	// to. For peers it's their Tailscale IP, which our known_hosts
+	// file has entries for, unless --no-resolve says to leave host
+	// as is (it then needs to be one of the peer's names there).
+	//
+	// If host isn't a peer but an IP in a peer's subnet route,
+	// router is that peer, which the ProxyCommand reaches it through.
+	var hostForSSH string
+	var peer, router *ipnstate.PeerStatus
+	var err error
+	if sshArgs.self {
+		self := st.Self
+		if self == nil || len(self.TailscaleIPs) == 0 {
+			return nil, errors.New("--self: this node has no Tailscale IP; is Tailscale up?")
+		}
+		if len(self.SSH_HostKeys) == 0 {
+			return nil, withKind(ErrSSHNotEnabled, errors.New("--self: this node has no SSH host keys; Tailscale SSH isn't enabled on it (run 'tailscale up --ssh')"))
+		}
+		peer, host, hostForSSH = self, strings.TrimSuffix(self.DNSName, "."), self.TailscaleIPs[0].String()
+		if hostForSSH, err = sshHostForIPFamily(peer, hostForSSH); err != nil {
+			return nil, err
+		}
+	} else {
+		peer, hostForSSH, err = resolvePeer(st, host)
+		if err != nil {
+			return nil, err
+		}
+		if hostForSSH, err = sshHostForIPFamily(peer, hostForSSH); err != nil {
+			return nil, err
+		}
+		if peer == nil {
+			router = sshSubnetRouter(st, hostForSSH)
+		}
+		if peer == nil && router == nil {
+			if err := sshPeerNotFoundError(st, host, sshArgs.check); err != nil {
+				return nil, err
+			}
+		}
 	}
-	tsConfDir := filepath.Join(confDir, "tailscale")
-	if err := os.MkdirAll(tsConfDir, 0700); err != nil {
-		return "", err
+	if sshArgs.noResolve {
+		hostForSSH = trimIPv6Brackets(host)
 	}
-	knownHostsFile = filepath.Join(tsConfDir, "ssh_known_hosts")
-	want := genKnownHosts(st)
-	if cur, err := os.ReadFile(knownHostsFile); err != nil || !bytes.Equal(cur, want) {
-		if err := os.WriteFile(knownHostsFile, want, 0644); err != nil {
-			return "", err
+	connectTimeout := sshArgs.timeout
+	if peer != nil && !sshArgs.self {
+		if err := checkSSHPeer(peer, !sshArgs.noKnownHosts && !sshArgs.acceptNewHostKeys); errors.Is(err, errPeerOffline) {
+			if connectTimeout == 0 {
+				connectTimeout = offlineSSHConnectTimeout
+			}
+			sshWarnf("%v; trying anyway, with a %v timeout.", err, connectTimeout)
+		} else if err != nil {
+			return nil, err
 		}
 	}
-	return knownHostsFile, nil
-}
+	if router != nil {
+		if err := checkSSHPeer(router, false); err != nil {
+			sshWarnf("subnet router %v; trying anyway.", err)
+		}
+	}
+	emitSSHEvent(sshEvent{
+		Event:  "resolved",
+		Host:   host,
+		Addr:   hostForSSH,
+		Peer:   newSSHEventPeer(peer),
+		Router: newSSHEventPeer(router),
+	})
 
-func genKnownHosts(st *ipnstate.Status) []byte {
-	var buf bytes.Buffer
-	for _, k := range st.Peers() {
-		ps := st.Peer[k]
-		for _, hk := range ps.SSH_HostKeys {
-			hostKey := strings.TrimSpace(hk)
-			if strings.ContainsAny(hostKey, "\n\r") { // invalid
-				continue
+	// jumpHost, if non-empty, is the "[user@]host" to hop through,
+	// resolved like the target.
+	var jumpHost string
+	var jumpPeer *ipnstate.PeerStatus
+	if sshArgs.jump != "" {
+		jumpUser, h, ok := strings.Cut(sshArgs.jump, "@")
+		if !ok {
+			h = sshArgs.jump
+		}
+		jumpPeer, jumpHost, err = resolvePeer(st, h)
+		if err == nil {
+			jumpHost, err = sshHostForIPFamily(jumpPeer, jumpHost)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jump host: %w", err)
+		}
+		if jumpPeer != nil {
+			if err := checkSSHPeer(jumpPeer, !sshArgs.noKnownHosts); err != nil {
+				return nil, fmt.Errorf("jump host: %w", err)
 			}
-			fmt.Fprintf(&buf, "%s %s\n", ps.DNSName, hostKey)
 		}
+		if ok {
+			jumpHost = jumpUser + "@" + jumpHost
+		}
+	}
+
+	// knownHostsFile is empty if we're not managing one and ssh
+	// should use its defaults.
+	//
+	// Tailscale doesn't know the host keys of hosts behind subnet
+	// routers, so for those ssh checks them as usual, against the
+	// user's own known_hosts.
+	var knownHostsFile string
+	if !sshArgs.noKnownHosts && router == nil {
+		phaseStart := time.Now()
+		knownHostsFile, err = writeKnownHosts(st, sshKnownHostsOptions(peer, jumpPeer))
+		if err != nil {
+			return nil, err
+		}
+		opts.timings.add("known_hosts write", phaseStart)
+		emitSSHEvent(sshEvent{Event: "known_hosts_written", KnownHostsFile: knownHostsFile})
 	}
-	return buf.Bytes()
+	resolvedAt := time.Now()
+	if sshArgs.verbose > 0 {
+		if hostForSSH != host {
+			log.Printf("resolved %q to %q", host, hostForSSH)
+		}
+		if router != nil {
+			log.Printf("%s is reached via subnet router %s", hostForSSH, strings.TrimSuffix(router.DNSName, "."))
+		}
+		if peer != nil && peer.CurAddr == "" && peer.Relay != "" {
+			log.Printf("connection to %s is relayed via DERP(%s)", peer.DNSName, peer.Relay)
+		}
+		if knownHostsFile != "" {
+			log.Printf("using known_hosts file %s", knownHostsFile)
+			warnSystemKnownHostsConflicts(systemKnownHostsFile, peer)
+		}
+	}
+	return &sshTarget{
+		hostForSSH:     hostForSSH,
+		peer:           peer,
+		router:         router,
+		jumpHost:       jumpHost,
+		knownHostsFile: knownHostsFile,
+		connectTimeout: connectTimeout,
+		resolvedAt:     resolvedAt,
+	}, nil
 }
 
-// nodeDNSNameFromArg returns the PeerStatus.DNSName value from a peer
-// in st that matches the input arg which can be a base name, full
-// DNS name, or an IP.
-func nodeDNSNameFromArg(st *ipnstate.Status, arg string) (dnsName string, ok bool) {
-	if arg == "" {
+// sshVerbosityFlags returns the ssh flags for how much ssh itself
+// should say: -v per --verbose (and -vvv for $TS_DEBUG_SSH_EXEC), or -q
+// for --quiet.
+func sshVerbosityFlags() []string {
+	var flags []string
+	if envknob.Bool("TS_DEBUG_SSH_EXEC") {
+		flags = append(flags, "-vvv")
+	}
+	if sshArgs.verbose > 0 {
+		flags = append(flags, "-"+strings.Repeat("v", int(sshArgs.verbose)))
+	}
+	if sshArgs.quiet {
+		flags = append(flags, "-q")
+	}
+	return flags
+}
+
+// sshWarnf prints a warning to Stderr, unless --quiet was given.
+func sshWarnf(format string, a ...any) {
+	if sshArgs.quiet {
 		return
 	}
-	argIP, _ := netaddr.ParseIP(arg)
-	for _, ps := range st.Peer {
-		dnsName = ps.DNSName
-		if !argIP.IsZero() {
-			for _, ip := range ps.TailscaleIPs {
-				if ip == argIP {
-					return dnsName, true
-				}
+	fmt.Fprintf(Stderr, "Warning: "+format+"\n", a...)
+}
+
+// sshTimings records how long the phases of setting up a connection
+// take, for --timings.
+type sshTimings struct {
+	phases []sshPhase
+}
+
+type sshPhase struct {
+	label string
+	d     time.Duration
+}
+
+// add records that the phase named label, which began at start, just
+// ended. It does nothing if t is nil.
+func (t *sshTimings) add(label string, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phases = append(t.phases, sshPhase{label, time.Since(start)})
+}
+
+func (t *sshTimings) print(w io.Writer) {
+	for _, p := range t.phases {
+		fmt.Fprintf(w, "timing: %-17s %v\n", p.label, p.d.Round(time.Microsecond))
+	}
+}
+
+// sshStatusError returns the error to report for err, from fetching
+// tailscaled's status. If err means tailscaled couldn't be reached at
+// all (its socket is missing or refuses connections), that's explained
+// in terms of tailscaled not running rather than a socket error, which
+// is only included with --verbose.
+func sshStatusError(err error) error {
+	var oe *net.OpError
+	if !errors.As(err, &oe) || oe.Op != "dial" {
+		return err
+	}
+	friendly := fixTailscaledConnectError(err)
+	if sshArgs.verbose > 0 {
+		friendly = fmt.Errorf("%v\n(underlying error: %w)", friendly, err)
+	}
+	return withKind(ErrTailscaledUnreachable, friendly)
+}
+
+// sshPeerNotFoundError returns the error for a host argument that
+// names no peer in st, or nil if it's fine to pass it to ssh as is (it
+// may be a host outside the tailnet). It's an error if the host is this
+// node (which --self is for), if it looks like a typo of a peer's name,
+// or if strict (as for --check).
+func sshPeerNotFoundError(st *ipnstate.Status, host string, strict bool) error {
+	if isSelfHost(st, host) {
+		return fmt.Errorf("%q is this machine, not a peer; to connect to it anyway use --self, which needs Tailscale SSH enabled here ('tailscale up --ssh')", host)
+	}
+	if sug, ok := suggestPeerName(st, host); ok {
+		return withKind(ErrPeerNotFound, fmt.Errorf("no peer %q; did you mean %q?", host, sug))
+	}
+	if strict {
+		return withKind(ErrPeerNotFound, fmt.Errorf("%q is not a peer in your tailnet", host))
+	}
+	return nil
+}
+
+// checkNativeSSHFlags returns an error if any flags were given that need
+// the system ssh, which wasn't found (per lookErr), rather than the
+// built-in client. The built-in client honors -v, by logging what it
+// does, and -q and --batch as is: it prints nothing of its own and
+// never prompts.
+func checkNativeSSHFlags(lookErr error) error {
+	if sshArgs.jump != "" {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--jump requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.bindAddress != "" {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--bind-address requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.escapeChar != "" {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--escape-char requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.hostKeyAlgos != "" {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--hostkey-algos requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.acceptNewHostKeys {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--accept-new-hostkeys requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.mux {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--mux requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.forwardAgent || len(sshArgs.localForwards) > 0 || len(sshArgs.remoteForwards) > 0 {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--forward-agent, -L and -R require a system 'ssh' command: %w", lookErr))
+	}
+	if len(sshArgs.options) > 0 {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("-o requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.localCommand != "" {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--local-command requires a system 'ssh' command: %w", lookErr))
+	}
+	if len(sshArgs.sendEnv) > 0 {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--send-env requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.compression {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--compression requires a system 'ssh' command: %w", lookErr))
+	}
+	if sshArgs.keepalive {
+		return withKind(ErrNoSSHBinary, fmt.Errorf("--keepalive requires a system 'ssh' command: %w", lookErr))
+	}
+	return nil
+}
+
+// sshStdin is where a "-" host argument is read from, and the built-in
+// client's session input. It's a variable for tests.
+var sshStdin io.Reader = os.Stdin
+
+// readSSHDestination returns the host argument given as "-", read from
+// the first line of r, as in "fzf | tailscale ssh -". It reads r a byte
+// at a time so as not to consume anything after that line, which is
+// left for ssh. Stdin being a pipe, ssh then won't allocate a terminal
+// unless -t is given.
+func readSSHDestination(r io.Reader) (string, error) {
+	const maxLen = 1024
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxLen {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
 			}
+			line = append(line, b[0])
 			continue
 		}
-		if strings.EqualFold(strings.TrimSuffix(arg, "."), strings.TrimSuffix(dnsName, ".")) {
-			return dnsName, true
+		if err == io.EOF {
+			break
 		}
-		if base, _, ok := strings.Cut(ps.DNSName, "."); ok && strings.EqualFold(base, arg) {
-			return dnsName, true
+		if err != nil {
+			return "", fmt.Errorf("reading host from stdin: %w", err)
 		}
 	}
-	return "", false
+	dest := strings.TrimSpace(string(line))
+	if dest == "" {
+		return "", errors.New(`no host on stdin for "-"`)
+	}
+	return dest, nil
+}
+
+// sshExpandEnv returns dest, the host argument, with --expand-env its
+// $VAR and ${VAR} references replaced by the environment variables'
+// values. It's an error if nothing's left, as when the variable isn't
+// set. Without --expand-env, dest is returned unchanged.
+func sshExpandEnv(dest string) (string, error) {
+	if !sshArgs.expandEnv {
+		return dest, nil
+	}
+	expanded := os.Expand(dest, os.Getenv)
+	if strings.TrimSpace(expanded) == "" {
+		return "", fmt.Errorf("--expand-env: host %q expands to nothing; is the variable set?", dest)
+	}
+	return expanded, nil
+}
+
+// parseSSHDestination parses the host argument to "tailscale ssh",
+// either "[user@]host" or an "ssh://[user@]host[:port]" URL. The
+// username is empty if not given, and the port zero.
+func parseSSHDestination(arg string) (username, host string, port int, err error) {
+	if !strings.HasPrefix(arg, "ssh://") {
+		username, host, ok := strings.Cut(arg, "@")
+		if !ok {
+			return "", arg, 0, nil
+		}
+		return username, host, 0, nil
+	}
+	u, err := url.Parse(arg)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid ssh URL %q: %w", arg, err)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", 0, fmt.Errorf("invalid ssh URL %q: only ssh://[user@]host[:port] is supported", arg)
+	}
+	if u.Hostname() == "" {
+		return "", "", 0, fmt.Errorf("invalid ssh URL %q: no host", arg)
+	}
+	if ps := u.Port(); ps != "" {
+		port, err = strconv.Atoi(ps)
+		if err != nil || port < 1 || port > 65535 {
+			return "", "", 0, fmt.Errorf("invalid ssh URL %q: bad port %q", arg, ps)
+		}
+	}
+	return u.User.Username(), u.Hostname(), port, nil
+}
+
+// sshHostWithoutPath returns host, the host part of the destination,
+// less any trailing "/path", if there's no remoteCommand. That's for
+// deployment tools that pass a copy target like "deploy@web1/var/www":
+// with no command to run, the path has no use, so the session is just
+// on the host. A command's meaning may depend on the path, so with one
+// the host is left as is, and fails to resolve, rather than the command
+// running somewhere unintended.
+func sshHostWithoutPath(host string, remoteCommand []string) string {
+	if len(remoteCommand) > 0 {
+		return host
+	}
+	if h, _, ok := cutPeerPath(host); ok {
+		return h
+	}
+	return host
+}
+
+// sshLoginName returns the name to log in as on host, given the user
+// from the "user@host" argument and the -l flag, at most one of which
+// may be set. If neither is, it's the one the user map file gives for
+// host, if any, or else sshDefaultUsername's. A user map that can't be
+// read or parsed is warned about and skipped, rather than blocking
+// every connection that names no user until it's fixed.
+func sshLoginName(destUser, loginFlag, host string) (string, error) {
+	switch {
+	case destUser != "" && loginFlag != "":
+		return "", fmt.Errorf("conflicting usernames: -l %s and %s@ in the host argument", loginFlag, destUser)
+	case loginFlag != "":
+		return loginFlag, nil
+	case destUser != "":
+		return destUser, nil
+	}
+	name, err := sshMappedUsername(host)
+	if err != nil {
+		sshWarnf("ignoring %v", err)
+	} else if name != "" {
+		return name, nil
+	}
+	return sshDefaultUsername()
+}
+
+// userCurrent is user.Current, overridden by tests.
+var userCurrent = user.Current
+
+// sshDefaultUsername returns the name to log in as when the host arg
+// has no "user@" part and the user map has none either:
+// $TS_SSH_DEFAULT_USER if set, for tailnets where every host has the
+// same login, or else the local user's, like ssh. If the OS can't say
+// who that is (as in some containers with no passwd entry), it falls
+// back to $USER or $LOGNAME.
+func sshDefaultUsername() (string, error) {
+	if name := envknob.String("TS_SSH_DEFAULT_USER"); name != "" {
+		return name, nil
+	}
+	lu, err := userCurrent()
+	if err == nil && lu.Username != "" {
+		return lu.Username, nil
+	}
+	for _, v := range []string{"USER", "LOGNAME"} {
+		if name := os.Getenv(v); name != "" {
+			return name, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("empty username")
+	}
+	return "", fmt.Errorf("can't determine the local username to log in as (%v); use user@host or set $TS_SSH_DEFAULT_USER", err)
+}
+
+// printSSHCheck prints, for --check, what a connection to t would do:
+// the peer's state (or the subnet router it's reached through), the
+// known_hosts file used, and the ssh command line, argv, or if nil,
+// that the built-in client would be used.
+func printSSHCheck(t *sshTarget, argv []string) {
+	if ps := t.peer; ps != nil {
+		ips := make([]string, len(ps.TailscaleIPs))
+		for i, ip := range ps.TailscaleIPs {
+			ips[i] = ip.String()
+		}
+		printf("peer:          %s (%s)\n", strings.TrimSuffix(ps.DNSName, "."), strings.Join(ips, ", "))
+		printf("online:        %v\n", ps.Online)
+		printf("SSH host keys: %d\n", len(ps.SSH_HostKeys))
+	} else {
+		printf("host:          %s (not a peer)\n", t.hostForSSH)
+		if t.router != nil {
+			printf("reached via:   subnet router %s\n", strings.TrimSuffix(t.router.DNSName, "."))
+		}
+	}
+	if t.knownHostsFile != "" {
+		printf("known_hosts:   %s\n", t.knownHostsFile)
+	}
+	if argv == nil {
+		printf("command:       (built-in SSH client; no system ssh found)\n")
+	} else {
+		printf("command:       %s\n", shellquote.Join(argv...))
+	}
+}
+
+// sshIPFamily returns the IP version that -4 or -6 selects, or 0 for
+// either.
+func sshIPFamily() int {
+	switch {
+	case sshArgs.ipv4:
+		return 4
+	case sshArgs.ipv6:
+		return 6
+	}
+	return 0
+}
+
+// ipInFamily reports whether ip is of IP version family, 4 or 6, or
+// whether family is 0, meaning either.
+func ipInFamily(ip netaddr.IP, family int) bool {
+	switch family {
+	case 4:
+		return ip.Is4()
+	case 6:
+		return ip.Is6()
+	}
+	return true
+}
+
+// sshHostForIPFamily returns the host to connect to instead of host, as
+// resolved by resolvePeer to peer ps (if non-nil), to use the IP
+// version that -4 or -6 selects: the peer's Tailscale IP of that
+// version. It's an error if the peer has none, or if there's no peer
+// and host is a literal IP of the other version.
+func sshHostForIPFamily(ps *ipnstate.PeerStatus, host string) (string, error) {
+	family := sshIPFamily()
+	if family == 0 {
+		return host, nil
+	}
+	if ip, err := netaddr.ParseIP(host); err == nil && ipInFamily(ip, family) {
+		return host, nil
+	}
+	if ps == nil {
+		if _, err := netaddr.ParseIP(host); err == nil {
+			return "", fmt.Errorf("-%d given, but %s is not an IPv%d address", family, host, family)
+		}
+		return host, nil
+	}
+	for _, ip := range ps.TailscaleIPs {
+		if ipInFamily(ip, family) {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no Tailscale IPv%d address", sshPeerName(ps), family)
+}
+
+// checkSSHPeer returns an error describing why an SSH connection to
+// peer ps can't work, if Status shows it can't: ps is offline, or, if
+// requireHostKeys, has no SSH host keys because Tailscale SSH isn't
+// enabled on it.
+//
+// The offline error wraps errPeerOffline, which callers may treat as
+// just a warning: Online is whether the peer is connected to the
+// control plane, and it may still be reachable.
+func checkSSHPeer(ps *ipnstate.PeerStatus, requireHostKeys bool) error {
+	name := sshPeerName(ps)
+	if requireHostKeys && len(ps.SSH_HostKeys) == 0 && ps.SSH_HostCAKey == "" {
+		return withKind(ErrSSHNotEnabled, fmt.Errorf("%s has no SSH host keys; Tailscale SSH isn't enabled on it (run 'tailscale up --ssh' there)", name))
+	}
+	if !ps.Online {
+		return fmt.Errorf("%s is %w", name, errPeerOffline)
+	}
+	return nil
+}
+
+var errPeerOffline = errors.New("offline")
+
+// sshPeerName returns ps's name for messages: its MagicDNS name, or if
+// it has none (as when it was resolved from a bare Tailscale IP), its
+// hostname or first Tailscale IP.
+func sshPeerName(ps *ipnstate.PeerStatus) string {
+	if name := strings.TrimSuffix(ps.DNSName, "."); name != "" {
+		return name
+	}
+	if ps.HostName != "" {
+		return ps.HostName
+	}
+	if len(ps.TailscaleIPs) > 0 {
+		return ps.TailscaleIPs[0].String()
+	}
+	return "peer"
+}
+
+// offlineSSHConnectTimeout is the connect timeout used for a target
+// peer that Status says is offline, when --timeout isn't given.
+const offlineSSHConnectTimeout = 10 * time.Second
+
+// sshConnectTimeoutOptions returns the ssh options for a connect
+// timeout of d, rounded up to whole seconds, or none if d is zero.
+func sshConnectTimeoutOptions(d time.Duration) []string {
+	if d <= 0 {
+		return nil
+	}
+	secs := (d + time.Second - 1) / time.Second
+	return []string{"-o", fmt.Sprintf("ConnectTimeout %d", secs)}
+}
+
+// sshHostOptionsWithUser returns sshHostOptions for knownHostsFile and
+// proxyCommand, with the options for --accept-new-hostkeys first and
+// the user's -o options, userOptions, before those. ssh uses the first
+// value it's given for an option, so the user's take precedence over
+// all the ones "tailscale ssh" sets, which must follow these.
+func sshHostOptionsWithUser(userOptions []string, knownHostsFile, proxyCommand string) []string {
+	var opts []string
+	opts = append(opts, userOptions...)
+	opts = append(opts, sshAcceptNewOptions()...)
+	opts = append(opts, sshHostOptions(knownHostsFile, proxyCommand)...)
+	return opts
+}
+
+// sshHostOptions returns the OpenSSH "-o" options that make ssh (or
+// scp, sftp) trust only the hosts in knownHostsFile, if non-empty,
+// and, if proxyCommand is non-empty, reach them via it.
+func sshHostOptions(knownHostsFile, proxyCommand string) []string {
+	var opts []string
+	if knownHostsFile != "" {
+		opts = append(opts,
+			// Only trust SSH hosts that we know about.
+			"-o", "UserKnownHostsFile "+sshQuotePath(knownHostsFile),
+			"-o", "UpdateHostKeys no",
+			"-o", "StrictHostKeyChecking yes",
+		)
+	}
+	if proxyCommand != "" {
+		opts = append(opts, "-o", "ProxyCommand "+proxyCommand)
+	}
+	return opts
+}
+
+// sshAcceptNewOptions returns the ssh options for
+// --accept-new-hostkeys, if given: ssh then adds an unknown host's key
+// to the known_hosts file rather than refusing to connect. A managed
+// known_hosts file is regenerated from Status on the next run, which
+// drops the added key in favor of the one Tailscale distributes.
+func sshAcceptNewOptions() []string {
+	if !sshArgs.acceptNewHostKeys {
+		return nil
+	}
+	return []string{"-o", "StrictHostKeyChecking accept-new"}
+}
+
+// sshSocket returns the tailscaled socket "tailscale ssh" uses.
+func sshSocket() string {
+	if sshArgs.socket != "" {
+		return sshArgs.socket
+	}
+	return rootArgs.socket
+}
+
+// sshTailscaleBin returns the path of the tailscale binary for the
+// ProxyCommand to run: --tailscale-bin, $TS_SSH_TAILSCALE_BIN, or else
+// this binary. The override is for when os.Executable returns a path
+// that can't be run again, as with some symlinked or AppImage installs.
+func sshTailscaleBin() (string, error) {
+	bin := sshArgs.tailscaleBin
+	if bin == "" {
+		bin = envknob.String("TS_SSH_TAILSCALE_BIN")
+	}
+	if bin == "" {
+		return os.Executable()
+	}
+	fi, err := os.Stat(bin)
+	if err != nil {
+		return "", fmt.Errorf("tailscale binary: %w", err)
+	}
+	if !fi.Mode().IsRegular() || (runtime.GOOS != "windows" && fi.Mode().Perm()&0111 == 0) {
+		return "", fmt.Errorf("tailscale binary %q is not an executable file", bin)
+	}
+	return bin, nil
+}
+
+// sshProxyCommand returns the OpenSSH ProxyCommand that dials hosts
+// via the tailscaled listening on socket, using tailscaleBin's nc
+// subcommand (or the one named by $TS_SSH_PROXY_NC_CMD, for custom
+// builds). It returns the empty string on platforms where that's not
+// used.
+//
+// It's an error if tailscaleBin or socket is empty, as can happen when
+// embedded, rather than leave ssh a ProxyCommand that fails obscurely.
+func sshProxyCommand(tailscaleBin, socket string) (string, error) {
+	// TODO(bradfitz): nc is currently broken on macOS:
+	// https://github.com/tailscale/tailscale/issues/4529
+	// So don't use it for now. MagicDNS is usually working on macOS anyway
+	// and they're not in userspace mode, so 'nc' isn't very useful.
+	if runtime.GOOS == "darwin" {
+		return "", nil
+	}
+	if tailscaleBin == "" {
+		return "", errors.New("no path to the tailscale binary for ssh's ProxyCommand; use --tailscale-bin")
+	}
+	if socket == "" {
+		return "", errors.New("no tailscaled socket path for ssh's ProxyCommand; use --socket")
+	}
+	nc := "nc"
+	if v := envknob.String("TS_SSH_PROXY_NC_CMD"); v != "" {
+		if !isSimpleToken(v) {
+			return "", fmt.Errorf("TS_SSH_PROXY_NC_CMD %q is not a plain subcommand name", v)
+		}
+		nc = v
+	}
+	return fmt.Sprintf("%s --socket=%s %s %%h %%p",
+		sshQuoteCommandArg(tailscaleBin),
+		sshQuoteCommandArg(socket),
+		sshJoinCommand(nc),
+	), nil
+}
+
+// isSimpleToken reports whether s is non-empty and only letters,
+// digits, '-', '_' and '.', so it's the same word to every shell.
+func isSimpleToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sshJumpProxyCommand returns the OpenSSH ProxyCommand that reaches the
+// target by running ssh (at path sshBin) to jumpHost ("[user@]host")
+// and forwarding through it with -W.
+//
+// It's used instead of OpenSSH's ProxyJump because ssh doesn't pass
+// our command-line options along to the jump connection, which then
+// needs them too: our known_hosts file, identities, and (as
+// jumpProxyCommand) the ProxyCommand to reach it via tailscaled. It
+// also gets its own ConnectTimeout, for --jump-timeout, rather than the
+// target's.
+func sshJumpProxyCommand(sshBin, jumpHost, knownHostsFile, jumpProxyCommand string) string {
+	jumpArgv := []string{sshBin}
+	jumpArgv = append(jumpArgv, sshConfigFileOptions()...)
+	jumpArgv = append(jumpArgv, sshHostOptions(knownHostsFile, jumpProxyCommand)...)
+	jumpArgv = append(jumpArgv, sshIdentityOptions()...)
+	jumpArgv = append(jumpArgv, sshConnectTimeoutOptions(sshArgs.jumpTimeout)...)
+	for i, a := range jumpArgv {
+		// The outer ssh expands %-tokens in the whole
+		// ProxyCommand; leave jumpProxyCommand's %h and %p for
+		// the jump ssh to expand.
+		jumpArgv[i] = strings.ReplaceAll(a, "%", "%%")
+	}
+	jumpArgv = append(jumpArgv, "-W", "[%h]:%p", jumpHost)
+	return sshJoinCommand(jumpArgv...)
+}
+
+// sshRemoteCommandArgs returns the remote command from args, the
+// arguments after the host. A leading "--", as in
+// "tailscale ssh web -- ls -la", only separates it from the host and
+// isn't part of it.
+func sshRemoteCommandArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// sshRemoteCommand returns the command line that ssh sends to the
+// remote host for the remote command args, to be run by the remote
+// user's shell: args joined with spaces, as OpenSSH does. So
+// "tailscale ssh host 'echo hello world'" and
+// "tailscale ssh host echo hello world" run the same command, whatever
+// the local platform and whether the system ssh or the built-in client
+// is used. The system ssh is given args as separate tokens, unchanged,
+// and does this itself.
+func sshRemoteCommand(args []string) string {
+	return strings.Join(args, " ")
+}
+
+// sshBindAddressFlags returns the ssh flags for --bind-address addr, or
+// none if addr is empty. It must be an IP address.
+//
+// ssh binds its own socket to it, so it has no effect when a
+// ProxyCommand (see sshProxyCommand) makes the connection instead.
+func sshBindAddressFlags(addr string) ([]string, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip, err := netaddr.ParseIP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("--bind-address %q is not an IP address", addr)
+	}
+	return []string{"-b", ip.String()}, nil
+}
+
+// sshEscapeCharFlags returns the ssh flags for --escape-char c, or none
+// if c is empty. As for ssh's -e, c must be a single (printable ASCII)
+// character, "^" and a letter for a control character, or "none".
+func sshEscapeCharFlags(c string) ([]string, error) {
+	switch {
+	case c == "":
+		return nil, nil
+	case c == "none",
+		len(c) == 1 && c[0] > ' ' && c[0] < 0x7f,
+		len(c) == 2 && c[0] == '^' && (c[1] >= 'a' && c[1] <= 'z' || c[1] >= 'A' && c[1] <= 'Z'):
+		return []string{"-e", c}, nil
+	}
+	return nil, fmt.Errorf("invalid --escape-char %q; want a single character, ^ and a letter, or \"none\"", c)
+}
+
+// sshConfigFileOptions returns the ssh flags for --no-ssh-config, if
+// given. Otherwise ssh reads the user's and system's ssh_config files as
+// usual, whose Host * (or Host 100.*, and so on) settings apply to its
+// connections to peers too.
+func sshConfigFileOptions() []string {
+	if !sshArgs.noSSHConfig {
+		return nil
+	}
+	return []string{"-F", "none"}
+}
+
+// sshIdentityOptions returns the OpenSSH "-o" options for the
+// --identity flags.
+func sshIdentityOptions() []string {
+	var opts []string
+	for _, f := range sshArgs.identities {
+		opts = append(opts, "-o", "IdentityFile "+sshQuotePath(f))
+	}
+	if len(sshArgs.identities) > 0 {
+		opts = append(opts, "-o", "IdentitiesOnly yes")
+	}
+	return opts
+}
+
+// knownHostKeyAlgos are the host key algorithms that --hostkey-algos
+// accepts, as OpenSSH names them.
+var knownHostKeyAlgos = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"rsa-sha2-512":                       true,
+	"rsa-sha2-256":                       true,
+	"ssh-rsa":                            true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// sshHostKeyAlgosOptions returns the ssh options for --hostkey-algos
+// spec, a comma-separated list of host key algorithms, or none if spec
+// is empty. Each must be in knownHostKeyAlgos, or its certificate
+// variant ("<name>-cert-v01@openssh.com").
+func sshHostKeyAlgosOptions(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	const certSuffix = "-cert-v01@openssh.com"
+	algos := strings.Split(spec, ",")
+	for _, a := range algos {
+		ok := knownHostKeyAlgos[a]
+		if strings.HasSuffix(a, certSuffix) {
+			base := strings.TrimSuffix(a, certSuffix)
+			ok = knownHostKeyAlgos[base] || knownHostKeyAlgos[base+"@openssh.com"]
+		}
+		if !ok {
+			return nil, fmt.Errorf("--hostkey-algos: unknown host key algorithm %q", a)
+		}
+	}
+	return []string{"-o", "HostKeyAlgorithms " + strings.Join(algos, ",")}, nil
+}
+
+// sshLocalCommandOptions returns the ssh options to run cmd on the local
+// machine after connecting, or none if cmd is empty.
+//
+// ssh takes the rest of a LocalCommand option line verbatim and runs it
+// with the user's shell, so cmd needs no quoting here; any %-tokens in
+// it are for ssh to expand.
+func sshLocalCommandOptions(cmd string) []string {
+	if cmd == "" {
+		return nil
+	}
+	return []string{
+		"-o", "PermitLocalCommand yes",
+		"-o", "LocalCommand " + cmd,
+	}
+}
+
+// allowedSSHOptions are the OpenSSH options that -o may set. It's a
+// short list on purpose: "tailscale ssh" isn't meant to take every
+// OpenSSH flag and option, and most others would interfere with how it
+// finds and verifies peers.
+//
+// They take precedence over the options "tailscale ssh" sets itself;
+// see sshHostOptionsWithUser.
+var allowedSSHOptions = []string{
+	"Compression",
+	"ConnectionAttempts",
+	"LogLevel",
+	"RequestTTY",
+	"ServerAliveCountMax",
+	"ServerAliveInterval",
+	"StrictHostKeyChecking",
+	"TCPKeepAlive",
+	"UserKnownHostsFile",
+}
+
+// sshUserOptions returns the ssh arguments for the -o options in opts,
+// each "Key=value" or "Key value", or an error if any isn't allowed by
+// allowedSSHOptions.
+func sshUserOptions(opts []string) ([]string, error) {
+	var args []string
+	for _, o := range opts {
+		k, v, ok := strings.Cut(strings.TrimSpace(o), "=")
+		if !ok {
+			k, v, ok = strings.Cut(strings.TrimSpace(o), " ")
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" || strings.ContainsAny(o, "\r\n") {
+			return nil, fmt.Errorf("invalid -o %q; want Key=value", o)
+		}
+		var allowed string
+		for _, a := range allowedSSHOptions {
+			if strings.EqualFold(k, a) {
+				allowed = a
+				break
+			}
+		}
+		if allowed == "" {
+			return nil, fmt.Errorf("-o %s is not supported; allowed options are %s", k, strings.Join(allowedSSHOptions, ", "))
+		}
+		args = append(args, "-o", allowed+" "+v)
+	}
+	return args, nil
+}
+
+// sshCompressionOptions returns the ssh options to turn compression on
+// or off for a connection to peer ps, which may be nil for non-peers.
+// Without --compression or --no-compression (or -o Compression), it's
+// turned on for connections relayed via DERP, where it helps more than
+// it costs, and otherwise left to ssh (which defaults to off).
+func sshCompressionOptions(ps *ipnstate.PeerStatus) []string {
+	switch {
+	case sshArgs.compression:
+		return []string{"-o", "Compression yes"}
+	case sshArgs.noCompression:
+		return []string{"-o", "Compression no"}
+	case hasUserSSHOption("Compression"):
+		return nil
+	case ps != nil && ps.CurAddr == "" && ps.Relay != "":
+		return []string{"-o", "Compression yes"}
+	}
+	return nil
+}
+
+// sshKeepaliveOptions returns the ssh options for keepalives on a
+// connection to peer ps, which may be nil for non-peers. Without
+// --keepalive or --no-keepalive (or -o ServerAliveInterval), they're
+// sent on connections relayed via DERP, which drop idle sessions
+// sooner, and otherwise left to ssh (which defaults to none).
+func sshKeepaliveOptions(ps *ipnstate.PeerStatus) []string {
+	on := []string{"-o", "ServerAliveInterval 15", "-o", "ServerAliveCountMax 3"}
+	switch {
+	case sshArgs.keepalive:
+		return on
+	case sshArgs.noKeepalive:
+		return []string{"-o", "ServerAliveInterval 0"}
+	case hasUserSSHOption("ServerAliveInterval"):
+		return nil
+	case ps != nil && ps.CurAddr == "" && ps.Relay != "":
+		return on
+	}
+	return nil
+}
+
+// hasUserSSHOption reports whether the OpenSSH option name was given
+// with -o.
+func hasUserSSHOption(name string) bool {
+	for _, o := range sshArgs.options {
+		k, _, _ := strings.Cut(strings.TrimSpace(o), "=")
+		k, _, _ = strings.Cut(k, " ")
+		if strings.EqualFold(strings.TrimSpace(k), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshBatchOptions returns the ssh options for --batch, which make ssh
+// fail rather than prompt. (The built-in client never prompts anyway.)
+func sshBatchOptions() []string {
+	if !sshArgs.batch {
+		return nil
+	}
+	return []string{
+		"-o", "BatchMode yes",
+		"-o", "StrictHostKeyChecking yes",
+	}
+}
+
+// sshTTYOptions returns the ssh options for -t or -T, if either was
+// given. Otherwise ssh decides whether to allocate a terminal, as usual.
+func sshTTYOptions() []string {
+	switch {
+	case sshArgs.tty:
+		return []string{"-o", "RequestTTY force"}
+	case sshArgs.noTTY:
+		return []string{"-o", "RequestTTY no"}
+	}
+	return nil
+}
+
+// sshConsoleTTYOptions returns the ssh options to always allocate a
+// terminal for an interactive session (there's no remoteCommand) run
+// from a Windows console, unless -t or -T was given. OpenSSH for
+// Windows doesn't always detect the console as a terminal when it's
+// started by another program, as it is here, and would then give the
+// session none.
+func sshConsoleTTYOptions(remoteCommand []string) []string {
+	if len(remoteCommand) > 0 || sshArgs.tty || sshArgs.noTTY || !sshConsoleAttached() {
+		return nil
+	}
+	return []string{"-o", "RequestTTY force"}
+}
+
+// sshWrapTTYOptions returns the ssh options to allocate a terminal, as
+// ssh does for a login shell, when --wrap is the interactive session
+// (there's no remoteCommand) and neither -t nor -T was given.
+func sshWrapTTYOptions(remoteCommand []string) []string {
+	if sshArgs.wrap == "" || len(remoteCommand) > 0 || sshArgs.tty || sshArgs.noTTY {
+		return nil
+	}
+	return []string{"-o", "RequestTTY yes"}
+}
+
+// sshWrapCommand returns remoteCommand run under wrap, the --wrap
+// command, if non-empty: wrap as given (it's shell syntax, run by the
+// remote user's shell like any remote command), then each arg of
+// remoteCommand quoted, so it reaches the wrapper as one argument. With
+// no remoteCommand, it's just wrap.
+func sshWrapCommand(wrap string, remoteCommand []string) []string {
+	if wrap == "" {
+		return remoteCommand
+	}
+	if len(remoteCommand) == 0 {
+		return []string{wrap}
+	}
+	return []string{wrap, shellquote.Join(remoteCommand...)}
+}
+
+// sshMuxEnabled reports whether ssh should share connections with
+// other sessions to the same user, host and port: --mux, --no-mux, or
+// else $TS_SSH_MUX. OpenSSH for Windows doesn't support it.
+func sshMuxEnabled() bool {
+	switch {
+	case sshArgs.mux:
+		return true
+	case sshArgs.noMux || runtime.GOOS == "windows":
+		return false
+	}
+	return envknob.Bool("TS_SSH_MUX")
+}
+
+// sshMuxOptions returns the ssh options to share connections via a
+// ControlMaster socket in sshStateDir, creating that directory if
+// needed.
+//
+// The first session for a user, host and port becomes the master.
+// Once its last session ends, the master lingers for ControlPersist
+// seconds for new sessions to reuse it, then exits and removes the
+// socket itself; nothing else needs cleaning up.
+func sshMuxOptions() ([]string, error) {
+	dir, err := makeSSHStateDir()
+	if err != nil {
+		return nil, err
+	}
+	// ssh expands %-tokens in ControlPath, so any in dir
+	// must be escaped; the ones we add are for ssh.
+	controlPath := filepath.Join(strings.ReplaceAll(dir, "%", "%%"), "ssh-mux-%r@%h:%p")
+	return []string{
+		"-o", "ControlMaster auto",
+		"-o", "ControlPersist 60",
+		"-o", "ControlPath " + sshQuotePath(controlPath),
+	}, nil
+}
+
+// defaultSSHSendEnv are the environment variables sent to the remote
+// session unless --no-send-env is given. ssh also sends TERM with the
+// pty request when it allocates one, but not otherwise.
+var defaultSSHSendEnv = []string{"TERM", "LANG", "LC_*"}
+
+// sshSendEnvOptions returns the ssh options to send the environment
+// variables named by defaultSSHSendEnv and --send-env. The values
+// themselves come from our own environment, which execSSH passes on.
+func sshSendEnvOptions() []string {
+	var names []string
+	if !sshArgs.noSendEnv {
+		names = append(names, defaultSSHSendEnv...)
+	}
+	names = append(names, sshArgs.sendEnv...)
+	var opts []string
+	for _, name := range names {
+		opts = append(opts, "-o", "SendEnv "+name)
+	}
+	return opts
+}
+
+// KnownHostsOptions controls which peers KnownHostsForStatus writes
+// entries for, and how. The zero value is the defaults for
+// "tailscale ssh".
+type KnownHostsOptions struct {
+	// IncludeOffline is whether to include all peers. Otherwise
+	// only peers that are online, or in Targets, are included, to
+	// keep the file small on large tailnets. (writeKnownHosts also
+	// keeps the peers its file already lists.)
+	IncludeOffline bool
+
+	// Targets are the peers being connected to, which are
+	// always included. Nil entries are ignored. The local node,
+	// st.Self, is only included if it's a target (as with --self).
+	Targets []*ipnstate.PeerStatus
+
+	// Hash is whether to write host names and IPs hashed, in
+	// OpenSSH's HashKnownHosts format, so the file doesn't reveal
+	// the tailnet's machines. The salts are random, but
+	// writeKnownHosts reuses those of the file it regenerates, so
+	// an up-to-date file isn't rewritten.
+	Hash bool
+
+	// OmitIPs is whether to list peers under their names only,
+	// not also their Tailscale IPs. "tailscale ssh" connects to
+	// peers by IP, so it needs them.
+	OmitIPs bool
+
+	// OmitShortNames is whether to list peers under their full
+	// MagicDNS names (and IPs) only, not also the first label of
+	// it, as "web" for web.foo.ts.net. Short names can collide, as
+	// between peers of the same name in different domains, so that
+	// one's key is matched for another.
+	OmitShortNames bool
+
+	// Port, if not 0 or 22, is the port ssh connects to peers on.
+	// Peers are then also listed as "[host]:port", which is how ssh
+	// looks up hosts on other ports.
+	Port int
+
+	// Comments is whether to start each peer's lines with a
+	// "# peer <name>" comment, for people reading the file. It's
+	// ignored with Hash, as the names would defeat the hashing.
+	Comments bool
+
+	// prevHashed is the hashed names of the file being
+	// regenerated, whose salts Hash reuses for the same hosts.
+	prevHashed []string
+}
+
+func (o KnownHostsOptions) include(ps *ipnstate.PeerStatus) bool {
+	return o.IncludeOffline || ps.Online || o.isTarget(ps)
+}
+
+func (o KnownHostsOptions) isTarget(ps *ipnstate.PeerStatus) bool {
+	for _, t := range o.Targets {
+		if t == ps {
+			return true
+		}
+	}
+	return false
+}
+
+// sshStateDir returns the directory for the files "tailscale ssh"
+// keeps, such as ssh_known_hosts: --known-hosts-dir if set, else
+// $TS_SSH_KNOWN_HOSTS_DIR, else the tailscale directory in the user's
+// config directory.
+func sshStateDir() (string, error) {
+	if dir := sshArgs.knownHostsDir; dir != "" {
+		return dir, nil
+	}
+	if dir := envknob.String("TS_SSH_KNOWN_HOSTS_DIR"); dir != "" {
+		return dir, nil
+	}
+	confDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(confDir, "tailscale"), nil
+}
+
+// makeSSHStateDir returns sshStateDir, creating it if needed. It's an
+// error if something other than a directory is in the way. As the
+// directory holds data about the tailnet's peers, it warns if an
+// existing one is accessible by other users.
+func makeSSHStateDir() (string, error) {
+	dir, err := sshStateDir()
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		// MkdirAll is fine with another "tailscale ssh"
+		// creating it concurrently.
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+		return dir, nil
+	case err != nil:
+		return "", err
+	case !fi.IsDir():
+		return "", fmt.Errorf("%s exists but is not a directory; move it out of the way, or use --known-hosts-dir to choose another directory", dir)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 && runtime.GOOS != "windows" {
+		sshWarnf("%s is accessible by other users (mode %#o), but holds data about your tailnet's peers; consider 'chmod 700 %s'.", dir, perm, dir)
+	}
+	return dir, nil
+}
+
+// sshKnownHostsOptions returns the KnownHostsOptions that the flags
+// select, for connecting to targets. -4 and -6 aren't among them: they
+// only choose which of a peer's IPs ssh connects to, and the file lists
+// both, as other runs (and generated ssh_config) may use either.
+func sshKnownHostsOptions(targets ...*ipnstate.PeerStatus) KnownHostsOptions {
+	return KnownHostsOptions{
+		IncludeOffline: sshArgs.includeOffline,
+		Targets:        targets,
+		Hash:           sshArgs.hashKnownHosts,
+		OmitShortNames: sshArgs.omitShortNames,
+		Port:           sshArgs.port,
+	}
+}
+
+// runSSHPrintKnownHosts implements "tailscale ssh --print-known-hosts",
+// printing the known_hosts file that connecting would generate, given
+// the same flags, without writing it.
+func runSSHPrintKnownHosts(ctx context.Context) error {
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
+	}
+	printSSHKnownHosts(st)
+	return nil
+}
+
+func printSSHKnownHosts(st *ipnstate.Status) {
+	opts := sshKnownHostsOptions()
+	opts.Comments = true // as writeKnownHosts does
+	kh, skipped := KnownHostsForStatus(st, opts)
+	warnSkippedHostKeys(skipped)
+	printf("%s", kh)
+}
+
+// warnSkippedHostKeys warns about the malformed host keys that
+// KnownHostsForStatus left out.
+func warnSkippedHostKeys(skipped []error) {
+	for _, err := range skipped {
+		sshWarnf("%v", err)
+	}
+}
+
+// sshConfigKnownHostsName is the name, in the state directory, of the
+// known_hosts file that ssh_config generated by --generate-config and
+// --print-config refers to. It's separate from the one for "tailscale
+// ssh" itself, as plain ssh may use it at any time and for any peer, so
+// it always lists them all, whatever the flags of the latest run.
+const sshConfigKnownHostsName = "ssh_config_known_hosts"
+
+// writeKnownHosts writes the known_hosts file for "tailscale ssh" and
+// its scp and sftp, with the peers in st that opts selects, and returns
+// its path. If the generated ssh_config's known_hosts file exists, it's
+// refreshed too, so that its host keys stay current.
+func writeKnownHosts(st *ipnstate.Status, opts KnownHostsOptions) (knownHostsFile string, err error) {
+	knownHostsFile, err = writeKnownHostsFile(st, knownHostsFileName(opts), opts)
+	if err != nil {
+		return "", err
+	}
+	if dir, err := sshStateDir(); err == nil {
+		if _, err := os.Stat(filepath.Join(dir, sshConfigKnownHostsName)); err == nil {
+			if _, err := writeSSHConfigKnownHosts(st); err != nil {
+				return "", err
+			}
+		}
+	}
+	return knownHostsFile, nil
+}
+
+// knownHostsFileName returns the name, in the state directory, of the
+// known_hosts file for "tailscale ssh" runs with opts. Options that
+// change how peers are listed, rather than which peers are, get a file
+// of their own, so that concurrent runs with and without them don't
+// rewrite each other's entries.
+func knownHostsFileName(opts KnownHostsOptions) string {
+	name := "ssh_known_hosts"
+	if opts.OmitShortNames {
+		name += "_fqdn"
+	}
+	if opts.Hash {
+		name += "_hashed"
+	}
+	if opts.Port != 0 && opts.Port != 22 {
+		name += "_port" + strconv.Itoa(opts.Port)
+	}
+	return name
+}
+
+// writeSSHConfigKnownHosts writes the known_hosts file for generated
+// ssh_config, listing all of st's peers, and returns its path.
+func writeSSHConfigKnownHosts(st *ipnstate.Status) (string, error) {
+	return writeKnownHostsFile(st, sshConfigKnownHostsName, KnownHostsOptions{IncludeOffline: true})
+}
+
+// writeKnownHostsFile writes the known_hosts file name, in the state
+// directory, with the peers in st that opts selects, if it's not
+// already up to date, and returns its path.
+//
+// Peers that the existing file lists stay in it, with their current
+// keys, even if opts wouldn't select them: other runs, connecting to
+// other offline peers, may have ssh about to read it. Only peers that
+// have left the tailnet are dropped.
+func writeKnownHostsFile(st *ipnstate.Status, name string, opts KnownHostsOptions) (knownHostsFile string, err error) {
+	tsConfDir, err := makeSSHStateDir()
+	if err != nil {
+		return "", err
+	}
+	knownHostsFile = filepath.Join(tsConfDir, name)
+	opts.Comments = true
+	mode := os.FileMode(sshArgs.knownHostsMode)
+	if mode == 0 {
+		mode = 0644
+	}
+	cur, err := os.ReadFile(knownHostsFile)
+	var problem string
+	if err == nil {
+		problem = knownHostsFileProblem(knownHostsFile, cur, mode)
+		if problem == "" {
+			opts.Targets = append(append([]*ipnstate.PeerStatus(nil), opts.Targets...), knownHostsPeers(st, cur)...)
+			_, opts.prevHashed = knownHostsNames(cur)
+		}
+	}
+	want, skipped := KnownHostsForStatus(st, opts)
+	warnSkippedHostKeys(skipped)
+	if err != nil || problem != "" || !bytes.Equal(cur, want) {
+		if problem != "" && sshArgs.verbose > 0 {
+			log.Printf("known_hosts file %s %s; regenerating it", knownHostsFile, problem)
+		}
+		// Write atomically so concurrent "tailscale ssh" runs (or
+		// a crash) never leave ssh a truncated file.
+		if err := atomicfile.WriteFile(knownHostsFile, want, mode); err != nil {
+			return "", err
+		}
+	}
+	return knownHostsFile, nil
+}
+
+// knownHostsFileProblem returns what's wrong with the existing
+// known_hosts file, whose contents are cur, besides being out of date:
+// that it doesn't parse, isn't owned by this user, or doesn't have the
+// permissions mode (except on Windows, whose files don't have Unix
+// permissions). It returns "" if there's nothing wrong.
+func knownHostsFileProblem(file string, cur []byte, mode os.FileMode) string {
+	for rest := cur; len(rest) > 0; {
+		var err error
+		_, _, _, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "is corrupt"
+		}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "can't be checked"
+	}
+	if perm := fi.Mode().Perm(); perm != mode && runtime.GOOS != "windows" {
+		return fmt.Sprintf("has mode %#o rather than %#o", perm, mode)
+	}
+	if fileOwnedByOther(fi) {
+		return "is owned by another user"
+	}
+	return ""
+}
+
+// knownHostsPeers returns the peers in st, and st.Self, that the
+// known_hosts file contents b lists, under the first of their names
+// that KnownHostsForStatus writes, hashed or not.
+func knownHostsPeers(st *ipnstate.Status, b []byte) []*ipnstate.PeerStatus {
+	plain, hashedNames := knownHostsNames(b)
+	hashed := knownHostsHashes{names: hashedNames}
+	var peers []*ipnstate.PeerStatus
+	if st.Self != nil {
+		peers = append(peers, st.Self)
+	}
+	for _, k := range st.Peers() {
+		peers = append(peers, st.Peer[k])
+	}
+	var listed []*ipnstate.PeerStatus
+	for _, ps := range peers {
+		name := knownHostsFirstName(ps)
+		if name == "" {
+			continue
+		}
+		if plain[strings.ToLower(name)] {
+			listed = append(listed, ps)
+		} else if _, ok := hashed.find(name); ok {
+			listed = append(listed, ps)
+		}
+	}
+	return listed
+}
+
+// knownHostsNames returns the host names that the known_hosts file
+// contents b lists: the plain ones, lowercased, and OpenSSH's hashed
+// ones, in order.
+func knownHostsNames(b []byte) (plain map[string]bool, hashed []string) {
+	plain = map[string]bool{}
+	for rest := b; len(rest) > 0; {
+		var hosts []string
+		var err error
+		_, hosts, _, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break // io.EOF
+		}
+		for _, h := range hosts {
+			if strings.HasPrefix(h, "|1|") {
+				hashed = append(hashed, h)
+			} else {
+				plain[strings.ToLower(h)] = true
+			}
+		}
+	}
+	return plain, hashed
+}
+
+// knownHostsFirstName returns the first name KnownHostsForStatus lists
+// ps under: its MagicDNS name, or if it has none, its first Tailscale
+// IP.
+func knownHostsFirstName(ps *ipnstate.PeerStatus) string {
+	for _, name := range peerHostNames(ps) {
+		if name != "" {
+			return name
+		}
+	}
+	if len(ps.TailscaleIPs) > 0 {
+		return ps.TailscaleIPs[0].String()
+	}
+	return ""
+}
+
+// knownHostsHashes is the hashed names in a known_hosts file, in
+// order, for finding which is a given host's.
+type knownHostsHashes struct {
+	names []string
+	next  int // where to start looking next
+}
+
+// find returns the hashed name that's host's, if any. A regenerated
+// file lists hosts in the same order, so looking from just after the
+// last match usually finds the next one right away, rather than hashing
+// host with every name's salt.
+func (hh *knownHostsHashes) find(host string) (hashed string, ok bool) {
+	n := len(hh.names)
+	for i := 0; i < n; i++ {
+		j := (hh.next + i) % n
+		if knownHostsHashMatches(hh.names[j], host) {
+			hh.next = j + 1
+			return hh.names[j], true
+		}
+	}
+	return "", false
+}
+
+// fileOwnedByOther reports whether fi's file is owned by a user other
+// than the current one. It's always false where files have no Unix
+// owner.
+var fileOwnedByOther = func(fi os.FileInfo) bool {
+	return false
+}
+
+// KnownHostsForStatus returns the contents of a known_hosts file for
+// the peers in st selected by opts. It's generated from st alone,
+// never merged with an existing file, so when a peer's host key
+// rotates its old key is dropped rather than left to conflict with the
+// new one. Malformed host keys are left out; skipped has an error for
+// each peer that had any, for the caller to report as it sees fit.
+func KnownHostsForStatus(st *ipnstate.Status, opts KnownHostsOptions) (kh []byte, skipped []error) {
+	var buf bytes.Buffer
+	// seen is the set of lines written so far, keyed on the
+	// unhashed line, so the same host key isn't repeated when peers
+	// (or a peer's names) overlap. Hashed lines are salted randomly
+	// and so can't be compared after the fact.
+	seen := map[string]bool{}
+	prevHashed := knownHostsHashes{names: opts.prevHashed}
+	var peers []*ipnstate.PeerStatus
+	if st.Self != nil && opts.isTarget(st.Self) {
+		peers = append(peers, st.Self)
+	}
+	for _, k := range st.Peers() {
+		peers = append(peers, st.Peer[k])
+	}
+	for _, ps := range peers {
+		if !opts.include(ps) {
+			continue
+		}
+		var hosts []string
+		hostSeen := map[string]bool{}
+		addHost := func(h string) {
+			if h != "" && !hostSeen[h] {
+				hostSeen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+		names := peerHostNames(ps)
+		if opts.OmitShortNames && len(names) > 1 {
+			names = names[:1] // the FQDN
+		}
+		for _, name := range names {
+			addHost(name)
+		}
+		if !opts.OmitIPs {
+			for _, ip := range ps.TailscaleIPs {
+				addHost(ip.String())
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		if opts.Port != 0 && opts.Port != 22 {
+			// Keep the bare hosts too, for a --jump host,
+			// which is connected to on its own port.
+			for _, h := range hosts {
+				addHost("[" + h + "]:" + strconv.Itoa(opts.Port))
+			}
+		}
+		hostKeys, malformed := validHostKeys(ps.SSH_HostKeys)
+		// marker is the known_hosts marker for the lines, if any.
+		var marker string
+		if ps.SSH_HostCAKey != "" {
+			// Trust the host certificates the CA signs
+			// instead of individual keys, so the peer's
+			// host keys can rotate without this file
+			// changing.
+			if ca, bad := validHostKeys([]string{ps.SSH_HostCAKey}); bad == 0 {
+				hostKeys, malformed, marker = ca, 0, "@cert-authority "
+			} else {
+				malformed += bad
+			}
+		}
+		var peerBuf bytes.Buffer
+		for _, hostKey := range hostKeys {
+			if !opts.Hash {
+				line := marker + strings.Join(hosts, ",") + " " + hostKey
+				if !seen[line] {
+					seen[line] = true
+					peerBuf.WriteString(line + "\n")
+				}
+				continue
+			}
+			// Hashed names can't be comma-joined; write a
+			// line per name, as ssh-keygen -H does.
+			for _, h := range hosts {
+				line := marker + h + " " + hostKey
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+				hashed, ok := prevHashed.find(h)
+				if !ok {
+					hashed = hashKnownHostsName(h)
+				}
+				fmt.Fprintf(&peerBuf, "%s%s %s\n", marker, hashed, hostKey)
+			}
+		}
+		if peerBuf.Len() > 0 && opts.Comments && !opts.Hash {
+			fmt.Fprintf(&buf, "# peer %s\n", hosts[0])
+		}
+		buf.Write(peerBuf.Bytes())
+		if malformed > 0 {
+			skipped = append(skipped, fmt.Errorf("skipped %d malformed host key(s) for peer %s", malformed, hosts[0]))
+		}
+	}
+	return buf.Bytes(), skipped
+}
+
+// validHostKeys returns the keys in keys that parse as SSH public keys,
+// as "type base64" with any comment stripped, and sorted by key type
+// and then value, so the known_hosts file is the same whatever order
+// the keys come in. It also returns how many were malformed and left
+// out, so a peer advertising garbage can't put it in the file.
+func validHostKeys(keys []string) (valid []string, malformed int) {
+	for _, hk := range keys {
+		hostKey := strings.TrimSpace(hk)
+		if hostKey == "" || strings.ContainsAny(hostKey, "\n\r") {
+			malformed++
+			continue
+		}
+		// ParseAuthorizedKey also accepts a leading options
+		// field, which has no place in known_hosts, so only
+		// keep what it parsed.
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			malformed++
+			continue
+		}
+		valid = append(valid, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))))
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		ti, vi, _ := strings.Cut(valid[i], " ")
+		tj, vj, _ := strings.Cut(valid[j], " ")
+		if ti != tj {
+			return ti < tj
+		}
+		return vi < vj
+	})
+	return valid, malformed
+}
+
+// hashKnownHostsName returns host in OpenSSH's hashed known_hosts
+// format (as with HashKnownHosts or ssh-keygen -H): "|1|", the
+// base64 of a random salt, "|", and the base64 of the HMAC-SHA1 of host
+// keyed by the salt.
+func hashKnownHostsName(host string) string {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha1.New, salt)
+	io.WriteString(mac, host)
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// peerFromArg returns the peer in st that matches the input arg,
+// which can be a base name, full DNS name, or an IP. IPv6 addresses
+// may be bracketed, as in "[fd7a:115c:a1e0::1]". It can also be
+// "nodeid:" and a stable node ID, or a node key ("nodekey:" and hex),
+// which unlike names survive the peer being renamed. It returns a nil
+// peer and error if nothing matches.
+//
+// An IP or full name identifies a peer uniquely, but several peers can
+// share a short name (as in web.foo.ts.net and web.bar.ts.net, through
+// node sharing). Then peers with SSH enabled are preferred, and of
+// those, online peers. If that still leaves more than one, it's an
+// error naming them.
+func peerFromArg(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, error) {
+	arg = strings.TrimSuffix(trimIPv6Brackets(arg), ".")
+	if arg == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(arg, "nodeid:") || strings.HasPrefix(arg, "nodekey:") {
+		return peerByNodeID(st, arg)
+	}
+	argIP, _ := netaddr.ParseIP(arg)
+	var shortMatches []*ipnstate.PeerStatus
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if !argIP.IsZero() {
+			for _, ip := range ps.TailscaleIPs {
+				if ip == argIP {
+					return ps, nil
+				}
+			}
+			continue
+		}
+		for i, name := range peerHostNames(ps) {
+			if !strings.EqualFold(arg, name) {
+				continue
+			}
+			if i == 0 { // the full MagicDNS name
+				return ps, nil
+			}
+			shortMatches = append(shortMatches, ps)
+			break
+		}
+	}
+	if len(shortMatches) == 0 {
+		return nil, nil
+	}
+	cands := preferPeers(shortMatches, func(ps *ipnstate.PeerStatus) bool { return len(ps.SSH_HostKeys) > 0 })
+	cands = preferPeers(cands, func(ps *ipnstate.PeerStatus) bool { return ps.Online })
+	if len(cands) == 1 {
+		return cands[0], nil
+	}
+	var names []string
+	for _, ps := range cands {
+		names = append(names, strings.TrimSuffix(ps.DNSName, "."))
+	}
+	return nil, fmt.Errorf("%q is ambiguous; it could be any of: %s", arg, strings.Join(names, ", "))
+}
+
+// peerByNodeID returns the peer in st identified by arg, either
+// "nodeid:" and its stable node ID or its node key in text form, or
+// nil if there's no such peer. It's an error if arg is a malformed node
+// key.
+func peerByNodeID(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, error) {
+	if id := strings.TrimPrefix(arg, "nodeid:"); id != arg {
+		for _, k := range st.Peers() {
+			if ps := st.Peer[k]; id != "" && string(ps.ID) == id {
+				return ps, nil
+			}
+		}
+		return nil, nil
+	}
+	var nk key.NodePublic
+	if err := nk.UnmarshalText([]byte(arg)); err != nil {
+		return nil, fmt.Errorf("invalid node key %q: %w", arg, err)
+	}
+	if nk.IsZero() {
+		return nil, nil
+	}
+	for _, k := range st.Peers() {
+		if ps := st.Peer[k]; k == nk || ps.PublicKey == nk {
+			return ps, nil
+		}
+	}
+	return nil, nil
+}
+
+// isSelfHost reports whether arg names this node, st.Self, by one of
+// its names or Tailscale IPs. peerFromArg never matches st.Self.
+func isSelfHost(st *ipnstate.Status, arg string) bool {
+	self := st.Self
+	if self == nil {
+		return false
+	}
+	arg = strings.TrimSuffix(trimIPv6Brackets(arg), ".")
+	if ip, err := netaddr.ParseIP(arg); err == nil {
+		for _, selfIP := range self.TailscaleIPs {
+			if ip == selfIP {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range peerHostNames(self) {
+		if name != "" && strings.EqualFold(arg, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferPeers returns the peers in peers for which pred is true, or
+// all of peers if it's true for none.
+func preferPeers(peers []*ipnstate.PeerStatus, pred func(*ipnstate.PeerStatus) bool) []*ipnstate.PeerStatus {
+	var ret []*ipnstate.PeerStatus
+	for _, ps := range peers {
+		if pred(ps) {
+			ret = append(ret, ps)
+		}
+	}
+	if len(ret) == 0 {
+		return peers
+	}
+	return ret
+}
+
+// peerHostNames returns the names that peer ps may be given by on the
+// command line and is listed under in known_hosts: its MagicDNS name,
+// without the trailing dot (as ssh compares names literally), and the
+// short form of that, its first label.
+//
+// Any other names a node is known by (aliases) would go here too, but
+// Status doesn't report any yet.
+func peerHostNames(ps *ipnstate.PeerStatus) []string {
+	fqdn := strings.TrimSuffix(ps.DNSName, ".")
+	if fqdn == "" {
+		return nil
+	}
+	if _, err := netaddr.ParseIP(fqdn); err == nil {
+		return []string{fqdn}
+	}
+	names := []string{fqdn}
+	if base, _, ok := strings.Cut(fqdn, "."); ok && base != "" {
+		names = append(names, base)
+	}
+	return names
+}
+
+// resolvePeer resolves the user-provided host arg in st, returning the
+// peer it names, if any, and the address to give ssh for it. For
+// peers, that's the peer's first Tailscale IP, so the connection
+// doesn't depend on MagicDNS (or split DNS) working on this machine.
+// Otherwise arg is returned unchanged (less any IPv6 brackets), with a
+// nil peer, so non-tailnet hosts still work.
+//
+// Callers use the peer for their later decisions (whether it has SSH
+// enabled, is online, or is relayed) rather than looking it up again.
+//
+// The returned address is never bracketed, as that's the form ssh
+// expects and passes as %h to the ProxyCommand.
+//
+// It's an error if arg is ambiguous; see peerFromArg.
+func resolvePeer(st *ipnstate.Status, arg string) (peer *ipnstate.PeerStatus, resolvedAddr string, err error) {
+	ps, err := peerFromArg(st, arg)
+	if err != nil {
+		return nil, "", err
+	}
+	if ps == nil {
+		return nil, trimIPv6Brackets(arg), nil
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return ps, ps.DNSName, nil
+	}
+	return ps, ps.TailscaleIPs[0].String(), nil
+}
+
+// sshSubnetRouter returns the peer in st whose subnet routes include
+// host, if host is an IP address (and not a peer's), or nil. As in
+// routing, the most specific route wins, as when one router has
+// 10.0.0.0/8 and another 10.1.0.0/16. Only the current exit node's
+// default routes count, as the others aren't in use.
+func sshSubnetRouter(st *ipnstate.Status, host string) *ipnstate.PeerStatus {
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		return nil
+	}
+	var best *ipnstate.PeerStatus
+	var bestBits uint8
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if ps.PrimaryRoutes == nil {
+			continue
+		}
+		for i := 0; i < ps.PrimaryRoutes.Len(); i++ {
+			r := ps.PrimaryRoutes.At(i)
+			if !r.Contains(ip) {
+				continue
+			}
+			if r.Bits() == 0 && !ps.ExitNode {
+				continue
+			}
+			if best == nil || r.Bits() > bestBits {
+				best, bestBits = ps, r.Bits()
+			}
+		}
+	}
+	return best
+}
+
+// trimIPv6Brackets returns host without the square brackets around a
+// literal IPv6 address, as in "[fd7a:115c:a1e0::1]". Other hosts are
+// returned unchanged.
+func trimIPv6Brackets(host string) string {
+	if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' && strings.Contains(host, ":") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// suggestPeerName returns the name of the peer in st that's closest to
+// arg, if one is close enough that arg is probably a typo of it. It's
+// used only after peerFromArg found no exact match. Args with a dot are
+// compared against peers' full DNS names, others against base names.
+func suggestPeerName(st *ipnstate.Status, arg string) (name string, ok bool) {
+	if _, err := netaddr.ParseIP(arg); err == nil {
+		return "", false
+	}
+	arg = strings.ToLower(strings.TrimSuffix(arg, "."))
+	best := -1
+	for _, k := range st.Peers() {
+		cand := strings.TrimSuffix(st.Peer[k].DNSName, ".")
+		if !strings.Contains(arg, ".") {
+			cand, _, _ = strings.Cut(cand, ".")
+		}
+		if cand == "" {
+			continue
+		}
+		d := levenshtein(arg, strings.ToLower(cand))
+		// Allow up to 2 edits, but not so many relative to the
+		// arg's length that unrelated short names match.
+		if d > 2 || d*3 > len(arg) {
+			continue
+		}
+		if best == -1 || d < best {
+			name, best = cand, d
+		}
+	}
+	return name, best != -1
+}
+
+// levenshtein returns the edit distance between a and b, counting
+// single-byte insertions, deletions, and substitutions.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if v := prev[j] + 1; v < cur[j] {
+				cur[j] = v
+			}
+			if v := cur[j-1] + 1; v < cur[j] {
+				cur[j] = v
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
 }
 
 // getSSHClientEnvVar returns the "SSH_CLIENT" environment variable
@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runSSHComplete implements "tailscale ssh --complete [partial]",
+// printing one per line the peer names that complete the partial
+// "[user@]host" argument, for use by shell completion scripts.
+//
+// It's meant to be called on every tab press, so it gives up quickly
+// and prints nothing if tailscaled is slow or unreachable.
+func runSSHComplete(ctx context.Context, partial string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return nil
+	}
+	for _, c := range sshCompletions(st, partial) {
+		outln(c)
+	}
+	return nil
+}
+
+// sshCompletions returns the sorted peer base names and full DNS names
+// in st that start with the host part of partial. If partial has a
+// "user@" prefix, it's kept on each completion.
+func sshCompletions(st *ipnstate.Status, partial string) []string {
+	var userPrefix string
+	hostPrefix := partial
+	if i := strings.LastIndex(partial, "@"); i != -1 {
+		userPrefix, hostPrefix = partial[:i+1], partial[i+1:]
+	}
+	hostPrefix = strings.ToLower(hostPrefix)
+
+	var out []string
+	seen := map[string]bool{}
+	for _, k := range st.Peers() {
+		fqdn := strings.TrimSuffix(st.Peer[k].DNSName, ".")
+		base, _, _ := strings.Cut(fqdn, ".")
+		for _, name := range []string{base, fqdn} {
+			if name == "" || seen[name] || !strings.HasPrefix(strings.ToLower(name), hostPrefix) {
+				continue
+			}
+			seen[name] = true
+			out = append(out, userPrefix+name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
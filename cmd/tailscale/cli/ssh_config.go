@@ -0,0 +1,151 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runSSHPrintConfig implements "tailscale ssh --print-config", printing
+// an OpenSSH config block that makes plain ssh reach tailnet peers by
+// MagicDNS name the way "tailscale ssh" does.
+func runSSHPrintConfig(ctx context.Context) error {
+	st, opts, err := sshConfigStatusAndOptions(ctx)
+	if err != nil {
+		return err
+	}
+	printf("%s", sshConfigHeader("--print-config")+sshConfigHostBlock(sshConfigHostPattern(st), opts))
+	return nil
+}
+
+// runSSHGenerateConfig implements "tailscale ssh --generate-config
+// [file]", generating an ssh_config file, for the user's ~/.ssh/config
+// to Include, with a Host block for each peer running Tailscale SSH.
+// With a file argument, it's written there atomically, and only if it
+// changed; otherwise it's printed.
+func runSSHGenerateConfig(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: ssh --generate-config [file]")
+	}
+	st, opts, err := sshConfigStatusAndOptions(ctx)
+	if err != nil {
+		return err
+	}
+	conf := genSSHConfig(st, opts)
+	if len(args) == 0 {
+		Stdout.Write(conf)
+		return nil
+	}
+	if cur, err := os.ReadFile(args[0]); err == nil && bytes.Equal(cur, conf) {
+		return nil
+	}
+	return atomicfile.WriteFile(args[0], conf, 0644)
+}
+
+// sshConfigStatusAndOptions returns tailscaled's status and the ssh
+// options for generated ssh_config to use for its peers, having written
+// the known_hosts file that the options refer to.
+func sshConfigStatusAndOptions(ctx context.Context) (*ipnstate.Status, []string, error) {
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return nil, nil, sshStatusError(err)
+	}
+	tailscaleBin, err := sshTailscaleBin()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Plain ssh may use the file for any peer, not just those online
+	// now, so it has its own, listing them all, which later
+	// "tailscale ssh" runs keep current.
+	knownHostsFile, err := writeSSHConfigKnownHosts(st)
+	if err != nil {
+		return nil, nil, err
+	}
+	proxyCommand, err := sshProxyCommand(tailscaleBin, sshSocket())
+	if err != nil {
+		return nil, nil, err
+	}
+	return st, sshHostOptions(knownHostsFile, proxyCommand), nil
+}
+
+// genSSHConfig returns the ssh_config for --generate-config: a Host
+// block for each peer in st with SSH host keys, sorted by name, matching
+// the peer's names and connecting to its Tailscale IP with opts. A base
+// name that more than one such peer has is left out, as ssh would only
+// ever use the first peer's block for it.
+func genSSHConfig(st *ipnstate.Status, opts []string) []byte {
+	var peers []*ipnstate.PeerStatus
+	nameCount := map[string]int{}
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if len(ps.SSH_HostKeys) == 0 || len(ps.TailscaleIPs) == 0 {
+			continue
+		}
+		peers = append(peers, ps)
+		for _, name := range peerHostNames(ps) {
+			nameCount[strings.ToLower(name)]++
+		}
+	}
+	ipnstate.SortPeers(peers)
+
+	var buf bytes.Buffer
+	buf.WriteString(sshConfigHeader("--generate-config"))
+	for _, ps := range peers {
+		var hosts []string
+		for _, name := range peerHostNames(ps) {
+			if name != "" && nameCount[strings.ToLower(name)] == 1 {
+				hosts = append(hosts, name)
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+		hostOpts := append([]string{"-o", "HostName " + ps.TailscaleIPs[0].String()}, opts...)
+		buf.WriteString("\n")
+		buf.WriteString(sshConfigHostBlock(strings.Join(hosts, " "), hostOpts))
+	}
+	return buf.Bytes()
+}
+
+// sshConfigHostPattern returns the ssh_config Host pattern matching the
+// MagicDNS names of st's tailnet.
+func sshConfigHostPattern(st *ipnstate.Status) string {
+	suffix := "ts.net"
+	if st.CurrentTailnet != nil && st.CurrentTailnet.MagicDNSSuffix != "" {
+		suffix = st.CurrentTailnet.MagicDNSSuffix
+	} else if st.MagicDNSSuffix != "" {
+		suffix = st.MagicDNSSuffix
+	}
+	return "*." + strings.TrimSuffix(suffix, ".")
+}
+
+// sshConfigHeader returns the comment at the top of ssh_config generated
+// by "tailscale ssh" with flag.
+func sshConfigHeader(flag string) string {
+	return "# Generated by \"tailscale ssh " + flag + "\". It includes the\n" +
+		"# path to the tailscale binary, so regenerate it after upgrading\n" +
+		"# or moving tailscale.\n"
+}
+
+// sshConfigHostBlock returns an ssh_config Host block for hostPattern
+// with the settings in opts, a list of "-o", "Key value" pairs as
+// returned by sshHostOptions.
+func sshConfigHostBlock(hostPattern string, opts []string) string {
+	var sb strings.Builder
+	sb.WriteString("Host " + hostPattern + "\n")
+	for i := 0; i+1 < len(opts); i += 2 {
+		if opts[i] == "-o" {
+			sb.WriteString("    " + opts[i+1] + "\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package cli
+
+// sshConsoleAttached reports whether stdin is a Windows console. It
+// never is elsewhere, where ssh's own terminal detection works as is.
+var sshConsoleAttached = func() bool { return false }
+
+// enableConsoleVT is a no-op outside Windows, where terminals already
+// interpret the remote side's escape sequences.
+func enableConsoleVT() (restore func()) { return func() {} }
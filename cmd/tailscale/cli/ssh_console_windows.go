@@ -0,0 +1,35 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// sshConsoleAttached reports whether stdin is a Windows console (as in
+// PowerShell or cmd, in conhost or Windows Terminal). Tests override
+// it.
+var sshConsoleAttached = func() bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(os.Stdin.Fd()), &mode) == nil
+}
+
+// enableConsoleVT turns on virtual terminal processing for the console
+// on stdout, if it is one, so the escape sequences a remote shell
+// sends are interpreted rather than printed, and returns a func that
+// restores the previous mode. Older conhosts don't default to it.
+func enableConsoleVT() (restore func()) {
+	h := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return func() {}
+	}
+	if err := windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+		return func() {}
+	}
+	return func() { windows.SetConsoleMode(h, mode) }
+}
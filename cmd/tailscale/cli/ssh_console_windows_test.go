@@ -0,0 +1,46 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSHConsoleTTYOptions(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	oldAttached := sshConsoleAttached
+	defer func() { sshConsoleAttached = oldAttached }()
+
+	force := []string{"-o", "RequestTTY force"}
+	tests := []struct {
+		name     string
+		attached bool
+		tty      bool
+		noTTY    bool
+		cmd      []string
+		want     []string
+	}{
+		{name: "console", attached: true, want: force},
+		{name: "no-console", attached: false},
+		{name: "command", attached: true, cmd: []string{"dir"}},
+		{name: "tty-flag", attached: true, tty: true},
+		{name: "no-tty-flag", attached: true, noTTY: true},
+	}
+	for _, tt := range tests {
+		sshConsoleAttached = func() bool { return tt.attached }
+		sshArgs.tty, sshArgs.noTTY = tt.tty, tt.noTTY
+		if got := sshConsoleTTYOptions(tt.cmd); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sshConsoleTTYOptions = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+	// With -T, the tty flags' own RequestTTY is the only one.
+	sshConsoleAttached = func() bool { return true }
+	sshArgs.tty, sshArgs.noTTY = false, true
+	if got := append(sshTTYOptions(), sshConsoleTTYOptions(nil)...); !reflect.DeepEqual(got, []string{"-o", "RequestTTY no"}) {
+		t.Errorf("with -T: options = %q; want RequestTTY no only", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshCopyIDScript is the remote shell script for --copy-id. It appends
+// each of its arguments, an authorized_keys line, to the remote user's
+// ~/.ssh/authorized_keys, creating them as only readable by the user if
+// need be, unless the same key is already there (with any comment or
+// options).
+const sshCopyIDScript = `set -e
+umask 077
+mkdir -p ~/.ssh
+f=~/.ssh/authorized_keys
+touch "$f"
+if [ -s "$f" ] && [ -n "$(tail -c1 "$f")" ]; then echo >> "$f"; fi
+for k in "$@"; do
+	t=$(printf '%s\n' "$k" | cut -d' ' -f1)
+	b=$(printf '%s\n' "$k" | cut -d' ' -f2)
+	if awk -v t="$t" -v b="$b" '{for (i = 1; i < NF; i++) if ($i == t && $(i+1) == b) found = 1} END {exit !found}' "$f"; then
+		echo "already installed: $k"
+	else
+		printf '%s\n' "$k" >> "$f"
+		echo "installed: $k"
+	fi
+done
+`
+
+// sshCopyIDCommand returns the remote command for --copy-id, as the
+// single, already quoted, argument to follow the host: it installs the
+// public keys of identityFiles, or if none, of the default
+// ~/.ssh/id_* keys.
+func sshCopyIDCommand(identityFiles []string) (string, error) {
+	keys, err := sshCopyIDKeys(identityFiles)
+	if err != nil {
+		return "", err
+	}
+	return shellquote.Join(append([]string{"sh", "-c", sshCopyIDScript, "sh"}, keys...)...), nil
+}
+
+// sshCopyIDKeys returns the authorized_keys lines for the public keys
+// of identityFiles (each the private key, whose public key is in the
+// ".pub" file next to it, or the ".pub" file itself), or if none, of
+// whichever default ~/.ssh/id_* keys there are.
+func sshCopyIDKeys(identityFiles []string) ([]string, error) {
+	var pubFiles []string
+	for _, f := range identityFiles {
+		if !strings.HasSuffix(f, ".pub") {
+			f += ".pub"
+		}
+		pubFiles = append(pubFiles, f)
+	}
+	if len(pubFiles) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			f := filepath.Join(home, ".ssh", name+".pub")
+			if _, err := os.Stat(f); err == nil {
+				pubFiles = append(pubFiles, f)
+			}
+		}
+		if len(pubFiles) == 0 {
+			return nil, errors.New("--copy-id: no public keys found in ~/.ssh; use -i to name one")
+		}
+	}
+	var keys []string
+	for _, f := range pubFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("--copy-id: %w", err)
+		}
+		pk, comment, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("--copy-id: public key file %q: %w", f, err)
+		}
+		line := string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(pk)))
+		if comment != "" {
+			line += " " + comment
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
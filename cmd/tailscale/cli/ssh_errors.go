@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors that "tailscale ssh" (and scp) failures match with errors.Is,
+// for programs that embed this package. The errors actually returned
+// have more descriptive messages.
+var (
+	// ErrNoSSHBinary means the system ssh (or scp) client is needed
+	// but isn't installed.
+	ErrNoSSHBinary = errors.New("no system ssh client")
+
+	// ErrPeerNotFound means the host argument doesn't name a peer in
+	// the tailnet, where one is required.
+	ErrPeerNotFound = errors.New("peer not found")
+
+	// ErrSSHNotEnabled means the target node doesn't run Tailscale SSH.
+	ErrSSHNotEnabled = errors.New("Tailscale SSH not enabled on peer")
+
+	// ErrTailscaledUnreachable means the local tailscaled couldn't be
+	// reached.
+	ErrTailscaledUnreachable = errors.New("tailscaled unreachable")
+
+	// ErrRemoteExit means the remote command, or shell, run by the
+	// built-in SSH client (used when there's no system ssh) exited with
+	// a non-zero status, which ExitCode returns. The remote side has
+	// already printed why, so there's nothing more to say about it.
+	ErrRemoteExit = errors.New("remote command failed")
+)
+
+// kindError is an error that keeps the message (and the unwrapping) of
+// its underlying error but also matches the sentinel kind.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e kindError) Error() string        { return e.err.Error() }
+func (e kindError) Unwrap() error        { return e.err }
+func (e kindError) Is(target error) bool { return target == e.kind }
+
+// withKind returns err marked as being of kind, one of the sentinel
+// errors above.
+func withKind(kind, err error) error {
+	return kindError{kind: kind, err: err}
+}
+
+// remoteExitError is the ErrRemoteExit error for a remote exit status.
+type remoteExitError struct {
+	code int
+}
+
+func (e remoteExitError) Error() string {
+	return fmt.Sprintf("remote command exited with status %d", e.code)
+}
+
+func (e remoteExitError) Is(target error) bool { return target == ErrRemoteExit }
+
+// Exit codes the tailscale command exits with when "tailscale ssh" (or
+// scp) fails before running ssh, one per failure class above, so scripts
+// can tell them apart without parsing the message. Once ssh runs, its own
+// exit code (the remote command's, or 255 for an ssh error) is passed
+// through instead, so a remote command exiting with one of these is
+// indistinguishable from them.
+const (
+	exitCodeError                 = 1 // any other error
+	exitCodePeerNotFound          = 3 // ErrPeerNotFound
+	exitCodeSSHNotEnabled         = 4 // ErrSSHNotEnabled
+	exitCodeTailscaledUnreachable = 5 // ErrTailscaledUnreachable
+	exitCodeNoSSHBinary           = 6 // ErrNoSSHBinary
+)
+
+// ExitCode returns the process exit code for err, an error returned by
+// Run: one of the codes above for the "tailscale ssh" failure classes,
+// the remote exit status for ErrRemoteExit, 1 for any other non-nil
+// error, and 0 for nil.
+func ExitCode(err error) int {
+	var re remoteExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &re):
+		return re.code
+	case errors.Is(err, ErrPeerNotFound):
+		return exitCodePeerNotFound
+	case errors.Is(err, ErrSSHNotEnabled):
+		return exitCodeSSHNotEnabled
+	case errors.Is(err, ErrTailscaledUnreachable):
+		return exitCodeTailscaledUnreachable
+	case errors.Is(err, ErrNoSSHBinary):
+		return exitCodeNoSSHBinary
+	}
+	return exitCodeError
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// sshEvent is a line of "tailscale ssh --json-events" output, for GUIs
+// and other wrappers that want to show connection progress.
+//
+// The events, in order, are:
+//
+//   - "resolved": the host argument was resolved; Host, Addr, and Peer
+//     (or Router, for a host behind a subnet router) are set.
+//   - "known_hosts_written": KnownHostsFile was written. Skipped
+//     if no known_hosts file is managed, as with --no-known-hosts.
+//   - "connecting": the connection to Addr is being made.
+//   - "connected": the SSH handshake with Addr succeeded.
+//   - "exited": the remote session ended with ExitCode.
+//
+// The system ssh replaces this process once it's started (on Unix), so
+// "connected" and "exited" are only seen from the built-in client, used
+// when there's no system ssh.
+type sshEvent struct {
+	Event          string        `json:"event"`
+	Time           time.Time     `json:"time"`
+	Host           string        `json:"host,omitempty"` // as given on the command line
+	Addr           string        `json:"addr,omitempty"` // the address ssh connects to
+	Peer           *sshEventPeer `json:"peer,omitempty"`
+	Router         *sshEventPeer `json:"router,omitempty"`
+	KnownHostsFile string        `json:"knownHostsFile,omitempty"`
+	ExitCode       *int          `json:"exitCode,omitempty"`
+}
+
+// sshEventPeer describes a peer in an sshEvent.
+type sshEventPeer struct {
+	DNSName      string   `json:"dnsName"`
+	TailscaleIPs []string `json:"tailscaleIPs"`
+	Online       bool     `json:"online"`
+}
+
+func newSSHEventPeer(ps *ipnstate.PeerStatus) *sshEventPeer {
+	if ps == nil {
+		return nil
+	}
+	ep := &sshEventPeer{
+		DNSName:      strings.TrimSuffix(ps.DNSName, "."),
+		TailscaleIPs: []string{},
+		Online:       ps.Online,
+	}
+	for _, ip := range ps.TailscaleIPs {
+		ep.TailscaleIPs = append(ep.TailscaleIPs, ip.String())
+	}
+	return ep
+}
+
+// emitSSHEvent writes ev to Stderr as a line of JSON, if --json-events
+// was given. Its Time is set to now.
+func emitSSHEvent(ev sshEvent) {
+	if !sshArgs.jsonEvents {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	Stderr.Write(append(j, '\n'))
+}
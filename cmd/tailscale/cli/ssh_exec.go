@@ -8,14 +8,17 @@
 package cli
 
 import (
-	"errors"
+	"fmt"
 	"os"
 	"syscall"
 )
 
+// sshExecReplacesProcess is whether execSSH replaces this process with
+// ssh, rather than running it as a child and returning once it exits.
+const sshExecReplacesProcess = true
+
 func execSSH(ssh string, argv []string) error {
-	if err := syscall.Exec(ssh, argv, os.Environ()); err != nil {
-		return err
-	}
-	return errors.New("unreachable")
+	// Exec only returns if it failed.
+	err := syscall.Exec(ssh, argv, os.Environ())
+	return fmt.Errorf("failed to exec %s: %w", ssh, err)
 }
@@ -8,6 +8,10 @@
 	"errors"
 )
 
+// sshExecReplacesProcess is whether execSSH replaces this process with
+// ssh. There's no ssh to run here at all.
+const sshExecReplacesProcess = false
+
 func execSSH(ssh string, argv []string) error {
 	return errors.New("Not implemented")
 }
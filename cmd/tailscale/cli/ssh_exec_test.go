@@ -0,0 +1,34 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js && !windows
+// +build !js,!windows
+
+package cli
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExecSSHError(t *testing.T) {
+	ssh := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(ssh, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := execSSH(ssh, []string{ssh, "host"})
+	if err == nil {
+		t.Fatal("exec of a non-executable file succeeded")
+	}
+	if want := "failed to exec " + ssh + ": "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error = %q; want it to start with %q", err, want)
+	}
+	if !errors.Is(err, syscall.EACCES) {
+		t.Errorf("error = %v; want it to wrap EACCES", err)
+	}
+}
@@ -8,18 +8,65 @@
 	"errors"
 	"os"
 	"os/exec"
+	"os/signal"
 )
 
+// sshExecReplacesProcess is whether execSSH replaces this process with
+// ssh. It doesn't here: it runs ssh as a child, and returns only if it
+// exits 0, exiting with ssh's code otherwise.
+const sshExecReplacesProcess = false
+
 func execSSH(ssh string, argv []string) error {
 	// Don't use syscall.Exec on Windows, it's not fully implemented.
 	cmd := exec.Command(ssh, argv[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	var ee *exec.ExitError
-	err := cmd.Run()
-	if errors.As(err, &ee) {
-		os.Exit(ee.ExitCode())
+	code, err := runChildSSH(cmd)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// runChildSSH runs cmd to completion and returns its exit code.
+//
+// Ctrl+C in the console is delivered to every process attached to it,
+// and the child ssh is attached to ours, since it's started without
+// CREATE_NEW_PROCESS_GROUP or DETACHED_PROCESS. So it already gets the
+// interrupt and decides what to do (in an interactive session it's
+// just input for the remote side); there's nothing to forward, and
+// Windows can't send os.Interrupt to another process anyway. We only
+// need to not die of it ourselves, and then wait for the child, so it
+// isn't orphaned and we can return its real exit code.
+func runChildSSH(cmd *exec.Cmd) (exitCode int, err error) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+	return waitChildSSH(cmd, sigc)
+}
+
+// waitChildSSH starts cmd and returns its exit code once it exits,
+// meanwhile receiving, and otherwise ignoring, the interrupts on sigc.
+func waitChildSSH(cmd *exec.Cmd, sigc <-chan os.Signal) (exitCode int, err error) {
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case <-sigc:
+			// The child got it too; see runChildSSH.
+		case err := <-done:
+			var ee *exec.ExitError
+			if errors.As(err, &ee) {
+				return ee.ExitCode(), nil
+			}
+			return 0, err
+		}
 	}
-	return err
 }
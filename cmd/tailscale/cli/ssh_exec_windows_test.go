@@ -0,0 +1,48 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestRunChildSSHExitCode(t *testing.T) {
+	for _, want := range []int{0, 3} {
+		// Stand-in for ssh after the remote side logs out
+		// cleanly (0) or a remote command fails (3).
+		cmd := exec.Command("cmd.exe", "/c", fmt.Sprintf("exit %d", want))
+		got, err := runChildSSH(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("exit code = %d; want %d", got, want)
+		}
+	}
+}
+
+func TestWaitChildSSHAfterInterrupt(t *testing.T) {
+	for _, want := range []int{0, 3} {
+		// Stand-in for ssh that keeps running for a second after
+		// Ctrl+C, then exits.
+		cmd := exec.Command("cmd.exe", "/c", fmt.Sprintf("ping -n 2 127.0.0.1 >nul & exit %d", want))
+		sigc := make(chan os.Signal, 2)
+		sigc <- os.Interrupt
+		sigc <- os.Interrupt
+		got, err := waitChildSSH(cmd, sigc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("exit code after interrupts = %d; want %d", got, want)
+		}
+		if len(sigc) != 0 {
+			t.Errorf("%d interrupts left unreceived while waiting", len(sigc))
+		}
+	}
+}
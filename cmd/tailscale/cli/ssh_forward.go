@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// sshForward is a parsed -L or -R port forwarding spec, of the form
+// "[bind:]port:host:hostport".
+type sshForward struct {
+	bind     string // optional; empty means ssh's default
+	port     int
+	host     string
+	hostPort int
+}
+
+// String returns f in ssh's -L/-R syntax.
+func (f sshForward) String() string {
+	s := bracketIPv6(f.host) + ":" + strconv.Itoa(f.hostPort)
+	s = strconv.Itoa(f.port) + ":" + s
+	if f.bind != "" {
+		s = bracketIPv6(f.bind) + ":" + s
+	}
+	return s
+}
+
+// parseSSHForward parses spec, the argument to -L or -R (as given by
+// flagName). Hosts may be bracketed IPv6 addresses. Only -R may listen on
+// port 0, which asks the server to pick a port.
+func parseSSHForward(flagName, spec string) (sshForward, error) {
+	var f sshForward
+	parts, err := splitSSHForward(spec)
+	if err != nil {
+		return f, fmt.Errorf("invalid -%s %q: %w", flagName, spec, err)
+	}
+	switch len(parts) {
+	case 3:
+	case 4:
+		f.bind, parts = trimIPv6Brackets(parts[0]), parts[1:]
+	default:
+		return f, fmt.Errorf("invalid -%s %q: want [bind:]port:host:hostport", flagName, spec)
+	}
+	minPort := 1
+	if flagName == "R" {
+		minPort = 0
+	}
+	if f.port, err = strconv.Atoi(parts[0]); err != nil || f.port < minPort || f.port > 65535 {
+		return f, fmt.Errorf("invalid -%s %q: bad port %q", flagName, spec, parts[0])
+	}
+	if f.host = trimIPv6Brackets(parts[1]); f.host == "" {
+		return f, fmt.Errorf("invalid -%s %q: empty host", flagName, spec)
+	}
+	if f.hostPort, err = strconv.Atoi(parts[2]); err != nil || f.hostPort < 1 || f.hostPort > 65535 {
+		return f, fmt.Errorf("invalid -%s %q: bad host port %q", flagName, spec, parts[2])
+	}
+	return f, nil
+}
+
+// splitSSHForward splits spec at colons that aren't inside square
+// brackets.
+func splitSSHForward(spec string) ([]string, error) {
+	var parts []string
+	start, inBracket := 0, false
+	for i, c := range spec {
+		switch c {
+		case '[':
+			if inBracket || i != start {
+				return nil, fmt.Errorf("unexpected '[' at offset %d", i)
+			}
+			inBracket = true
+		case ']':
+			if !inBracket {
+				return nil, fmt.Errorf("unexpected ']' at offset %d", i)
+			}
+			inBracket = false
+		case ':':
+			if !inBracket {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if inBracket {
+		return nil, fmt.Errorf("unterminated '['")
+	}
+	return append(parts, spec[start:]), nil
+}
+
+// sshForwardArgs returns the ssh arguments for our -L and -R flags,
+// with forwarding targets that name tailnet peers resolved to their
+// Tailscale IPs, so "-L 8080:web:80" works even where web's MagicDNS
+// name doesn't resolve.
+func sshForwardArgs(st *ipnstate.Status) ([]string, error) {
+	var args []string
+	for _, fl := range []struct {
+		name  string
+		specs []string
+	}{
+		{"L", sshArgs.localForwards},
+		{"R", sshArgs.remoteForwards},
+	} {
+		for _, spec := range fl.specs {
+			f, err := parseSSHForward(fl.name, spec)
+			if err != nil {
+				return nil, err
+			}
+			_, f.host, err = resolvePeer(st, f.host)
+			if err != nil {
+				return nil, fmt.Errorf("-%s %q: %w", fl.name, spec, err)
+			}
+			args = append(args, "-"+fl.name, f.String())
+		}
+	}
+	return args, nil
+}
+
+// bracketIPv6 returns host in square brackets if it's an IPv6 address,
+// or unchanged otherwise.
+func bracketIPv6(host string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
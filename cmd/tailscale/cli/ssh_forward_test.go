@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestParseSSHForward(t *testing.T) {
+	tests := []struct {
+		flag    string
+		spec    string
+		want    sshForward
+		wantErr bool
+	}{
+		{flag: "L", spec: "8080:web:80", want: sshForward{port: 8080, host: "web", hostPort: 80}},
+		{flag: "L", spec: "127.0.0.1:8080:web:80", want: sshForward{bind: "127.0.0.1", port: 8080, host: "web", hostPort: 80}},
+		{flag: "L", spec: "[::1]:8080:[fd7a:115c:a1e0::1]:80", want: sshForward{bind: "::1", port: 8080, host: "fd7a:115c:a1e0::1", hostPort: 80}},
+		{flag: "R", spec: "0:localhost:22", want: sshForward{port: 0, host: "localhost", hostPort: 22}},
+		{flag: "L", spec: "0:localhost:22", wantErr: true},
+		{flag: "L", spec: "8080:web", wantErr: true},
+		{flag: "L", spec: "a:b:c:d:e", wantErr: true},
+		{flag: "L", spec: "x:web:80", wantErr: true},
+		{flag: "L", spec: "8080:web:70000", wantErr: true},
+		{flag: "L", spec: "8080::80", wantErr: true},
+		{flag: "L", spec: "8080:[::1:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSSHForward(tt.flag, tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("-%s %q: got %+v, want error", tt.flag, tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-%s %q: %v", tt.flag, tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("-%s %q: got %+v, want %+v", tt.flag, tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSSHForwardArgs(t *testing.T) {
+	oldL, oldR := sshArgs.localForwards, sshArgs.remoteForwards
+	defer func() { sshArgs.localForwards, sshArgs.remoteForwards = oldL, oldR }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.5")},
+			},
+			testNodeKey(2): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("fd7a:115c:a1e0::6")},
+			},
+		},
+	}
+	sshArgs.localForwards = stringsFlag{"8080:web:80", "127.0.0.1:5432:db:5432"}
+	sshArgs.remoteForwards = stringsFlag{"9000:localhost:9000"}
+	got, err := sshForwardArgs(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-L", "8080:100.64.0.5:80",
+		"-L", "127.0.0.1:5432:[fd7a:115c:a1e0::6]:5432",
+		"-R", "9000:localhost:9000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	sshArgs.remoteForwards = stringsFlag{"bogus"}
+	if _, err := sshForwardArgs(st); err == nil {
+		t.Error("bad -R: got nil error")
+	}
+}
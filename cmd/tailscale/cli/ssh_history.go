@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/atomicfile"
+)
+
+// sshHistoryMax is how many destinations the recent-hosts history
+// keeps.
+const sshHistoryMax = 20
+
+// runSSHRecent implements "tailscale ssh --recent", printing the
+// destinations recently connected to, most recent first.
+func runSSHRecent() error {
+	file, err := sshHistoryFile()
+	if err != nil {
+		return err
+	}
+	hist, err := readSSHHistory(file)
+	if err != nil {
+		return err
+	}
+	for _, dest := range hist {
+		outln(dest)
+	}
+	return nil
+}
+
+func sshHistoryFile() (string, error) {
+	dir, err := sshStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ssh-history"), nil
+}
+
+// readSSHHistory returns the destinations in the history file, most
+// recent first. A missing file is an empty history.
+func readSSHHistory(file string) ([]string, error) {
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hist []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			hist = append(hist, line)
+		}
+	}
+	return hist, nil
+}
+
+// addSSHHistory moves dest, a destination argument as given to
+// "tailscale ssh", to the front of the history file, adding it if it's
+// not there, and drops the oldest entries beyond sshHistoryMax. The
+// file is only readable by the user, as it names the tailnet's peers.
+func addSSHHistory(file, dest string) error {
+	hist, err := readSSHHistory(file)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(dest + "\n")
+	n := 1
+	for _, h := range hist {
+		if n == sshHistoryMax {
+			break
+		}
+		if h != dest {
+			buf.WriteString(h + "\n")
+			n++
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(file, buf.Bytes(), 0600)
+}
+
+// recordSSHHistory adds dest to the recent-hosts history, unless
+// --no-history was given. It's best effort: a history that can't be
+// written isn't worth failing the connection over.
+func recordSSHHistory(dest string) {
+	if sshArgs.noHistory || dest == "" || strings.ContainsAny(dest, "\r\n") {
+		return
+	}
+	file, err := sshHistoryFile()
+	if err != nil {
+		return
+	}
+	addSSHHistory(file, dest)
+}
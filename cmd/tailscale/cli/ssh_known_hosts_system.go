@@ -0,0 +1,150 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// systemKnownHostsFile is the system-wide known_hosts file that ssh
+// reads by default (its GlobalKnownHostsFile), alongside the one
+// "tailscale ssh" generates. Tests override it.
+var systemKnownHostsFile = defaultSystemKnownHostsFile()
+
+func defaultSystemKnownHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "ssh", "ssh_known_hosts")
+	}
+	return "/etc/ssh/ssh_known_hosts"
+}
+
+// warnSystemKnownHostsConflicts warns about each of ps's names that
+// file, a system-wide known_hosts file, lists with host keys that
+// differ from those Tailscale has for ps, for --verbose. Such an entry
+// is stale, or for another machine, and is confusing at best when ssh
+// reads both files. It's best effort: a missing or unreadable file is
+// no conflict.
+func warnSystemKnownHostsConflicts(file string, ps *ipnstate.PeerStatus) {
+	for _, name := range systemKnownHostsConflicts(file, ps, sshArgs.port) {
+		sshWarnf("%s lists %s with a different host key than Tailscale has for it; if it's stale, remove it", file, name)
+	}
+}
+
+// systemKnownHostsConflicts returns the names of ps (as in the
+// generated known_hosts file, with port if it's not 0 or 22) that file
+// lists only with keys other than ps's of the same type. Lines with a
+// marker, such as @cert-authority, and host patterns with wildcards
+// aren't considered, nor are peers whose host keys are signed by a CA.
+func systemKnownHostsConflicts(file string, ps *ipnstate.PeerStatus, port int) []string {
+	if ps == nil || ps.SSH_HostCAKey != "" {
+		return nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	// ours is ps's host keys, by type.
+	ours := map[string]map[string]bool{}
+	hostKeys, _ := validHostKeys(ps.SSH_HostKeys)
+	for _, hk := range hostKeys {
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hk))
+		if err != nil {
+			continue
+		}
+		if ours[pk.Type()] == nil {
+			ours[pk.Type()] = map[string]bool{}
+		}
+		ours[pk.Type()][string(pk.Marshal())] = true
+	}
+	names := peerHostNames(ps)
+	for _, ip := range ps.TailscaleIPs {
+		names = append(names, ip.String())
+	}
+	if port != 0 && port != 22 {
+		for i, n := range names {
+			names[i] = "[" + n + "]:" + strconv.Itoa(port)
+		}
+	}
+
+	matched := map[string]bool{}
+	mismatched := map[string]bool{}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		marker, hosts, pk, _, _, err := ssh.ParseKnownHosts(line)
+		if err != nil || marker != "" {
+			continue // io.EOF for blank lines and comments
+		}
+		keys, ok := ours[pk.Type()]
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			if !knownHostsListsHost(hosts, name) {
+				continue
+			}
+			if keys[string(pk.Marshal())] {
+				matched[name] = true
+			} else {
+				mismatched[name] = true
+			}
+		}
+	}
+	var conflicts []string
+	for _, name := range names {
+		if mismatched[name] && !matched[name] {
+			conflicts = append(conflicts, name)
+		}
+	}
+	return conflicts
+}
+
+// knownHostsListsHost reports whether hosts, the host field of a
+// known_hosts line split on commas, lists host, by name or as one of
+// OpenSSH's hashed names.
+func knownHostsListsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if strings.HasPrefix(h, "|1|") {
+			if knownHostsHashMatches(h, host) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHostsHashMatches reports whether hashed, a "|1|salt|hash"
+// hashed known_hosts name as written by hashKnownHostsName, is host's.
+func knownHostsHashMatches(hashed, host string) bool {
+	salt64, hash64, ok := strings.Cut(strings.TrimPrefix(hashed, "|1|"), "|")
+	if !ok {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	io.WriteString(mac, host)
+	return hmac.Equal(mac.Sum(nil), want)
+}
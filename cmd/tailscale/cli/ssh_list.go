@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// sshListPeer is a peer as printed by "tailscale ssh --list --json".
+type sshListPeer struct {
+	DNSName      string
+	Online       bool
+	TailscaleIPs []netaddr.IP
+}
+
+// runSSHList implements "tailscale ssh --list [pattern]", printing the
+// peers that have Tailscale SSH enabled, or if pattern is non-empty,
+// those of them it matches (see matchPeerPattern). It doesn't connect
+// to any of them.
+func runSSHList(ctx context.Context, pattern string) error {
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
+	}
+	peers, err := sshListPeers(st, pattern)
+	if err != nil {
+		return err
+	}
+	if sshArgs.json {
+		if peers == nil {
+			peers = []sshListPeer{} // print [], not null
+		}
+		j, err := json.MarshalIndent(peers, "", "  ")
+		if err != nil {
+			return err
+		}
+		printf("%s\n", j)
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, p := range peers {
+		status := "offline"
+		if p.Online {
+			status = "online"
+		}
+		ips := make([]string, len(p.TailscaleIPs))
+		for i, ip := range p.TailscaleIPs {
+			ips[i] = ip.String()
+		}
+		fmt.Fprintf(&buf, "%-40s %-7s %s\n", p.DNSName, status, strings.Join(ips, ", "))
+	}
+	Stdout.Write(buf.Bytes())
+	return nil
+}
+
+// sshListPeers returns the peers in st with SSH host keys, which is to
+// say those running Tailscale SSH, sorted by name. If pattern is
+// non-empty, only the peers it matches are returned.
+func sshListPeers(st *ipnstate.Status, pattern string) ([]sshListPeer, error) {
+	var peers []*ipnstate.PeerStatus
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if len(ps.SSH_HostKeys) == 0 {
+			continue
+		}
+		if pattern != "" {
+			ok, err := matchPeerPattern(pattern, ps)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		peers = append(peers, ps)
+	}
+	ipnstate.SortPeers(peers)
+	var ret []sshListPeer
+	for _, ps := range peers {
+		ret = append(ret, sshListPeer{
+			DNSName:      strings.TrimSuffix(ps.DNSName, "."),
+			Online:       ps.Online,
+			TailscaleIPs: ps.TailscaleIPs,
+		})
+	}
+	return ret, nil
+}
+
+// isPeerPattern reports whether the host argument s is a glob pattern,
+// for matchPeerPattern, rather than a name or IP. A bracketed IPv6
+// address, as in "[fd7a:115c:a1e0::1]", isn't a pattern.
+func isPeerPattern(s string) bool {
+	if _, err := netaddr.ParseIP(trimIPv6Brackets(s)); err == nil {
+		return false
+	}
+	return strings.ContainsAny(s, "*?[")
+}
+
+// matchPeerPattern reports whether the glob pattern, with path.Match
+// syntax, matches ps's MagicDNS name, either its short first label or
+// the whole name. Matching is case-insensitive.
+func matchPeerPattern(pattern string, ps *ipnstate.PeerStatus) (bool, error) {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name := strings.ToLower(strings.TrimSuffix(ps.DNSName, "."))
+	if name == "" {
+		return false, nil
+	}
+	short, _, _ := strings.Cut(name, ".")
+	for _, n := range []string{short, name} {
+		ok, err := path.Match(pattern, n)
+		if err != nil {
+			return false, fmt.Errorf("bad host pattern %q: %w", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+	"inet.af/netaddr"
+)
+
+// runSSHNative connects to t's host as username using Go's SSH client
+// rather than the system ssh binary. It's used when no ssh binary is
+// installed (minimal containers, many Windows machines).
+//
+// The TCP connection is made via tailscaled, like the ProxyCommand
+// does for the system ssh, and the host key is verified against
+// t.knownHostsFile, as generated by writeKnownHosts, or if empty, the
+// user's ~/.ssh/known_hosts.
+//
+// If t.connectTimeout is non-zero, it bounds the dial and SSH
+// handshake. Once that succeeds, dest, the destination as given, is
+// added to the recent-hosts history. If the remote side exits with a
+// non-zero status, the error matches ErrRemoteExit.
+func runSSHNative(ctx context.Context, username string, t *sshTarget, dest string, args []string) error {
+	host, knownHostsFile := t.hostForSSH, t.knownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return err
+	}
+	port := uint16(22)
+	if sshArgs.port != 0 {
+		port = uint16(sshArgs.port)
+	}
+	remoteAddr := nativeSSHRemoteAddr(t, port)
+	if sshArgs.verbose > 0 {
+		log.Printf("Connecting to %s with the built-in SSH client, checking host keys in %s", remoteAddr, knownHostsFile)
+	}
+	dialCtx := ctx
+	if t.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, t.connectTimeout)
+		defer cancel()
+	}
+	conn, err := nativeSSHDial(dialCtx, host, port)
+	if err != nil {
+		return fmt.Errorf("Dial(%q, %v): %w", host, port, err)
+	}
+	if t.connectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.connectTimeout))
+	}
+	auth, err := nativeSSHAuthMethods(sshArgs.identities)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ClientConfig{
+		User: username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			// The conn's remote address is tailscaled's local
+			// socket, not the host's.
+			return hostKeyCallback(hostname, remoteAddr, key)
+		},
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(host, fmt.Sprint(port)), config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if sshArgs.verbose > 0 {
+		log.Printf("Authenticated to %s as %q", remoteAddr, username)
+	}
+	emitSSHEvent(sshEvent{Event: "connected", Addr: host})
+	recordSSHHistory(dest)
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	sess.Stdin = sshStdin
+	sess.Stdout = Stdout
+	sess.Stderr = Stderr
+
+	fd := int(os.Stdin.Fd())
+	isTerm := term.IsTerminal(fd)
+	if (isTerm || sshArgs.tty) && !sshArgs.noTTY {
+		outFd := int(os.Stdout.Fd())
+		w, h, err := termGetSize(outFd)
+		if err != nil {
+			w, h = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm"
+			if sshConsoleAttached() {
+				// Windows consoles have no $TERM, but
+				// handle 256 colors.
+				termType = "xterm-256color"
+			}
+		}
+		if err := sess.RequestPty(termType, h, w, ssh.TerminalModes{}); err != nil {
+			return fmt.Errorf("requesting pty: %w", err)
+		}
+		defer forwardWindowSize(sess, outFd, w, h)()
+	}
+	if isTerm && !sshArgs.noTTY {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, oldState)
+		defer enableConsoleVT()()
+	}
+
+	if len(args) == 0 {
+		err = sess.Shell()
+	} else {
+		err = sess.Start(sshRemoteCommand(args))
+	}
+	if err != nil {
+		return err
+	}
+	err = sess.Wait()
+	var ee *ssh.ExitError
+	if err == nil {
+		code := 0
+		emitSSHEvent(sshEvent{Event: "exited", Addr: host, ExitCode: &code})
+	}
+	if errors.As(err, &ee) {
+		code := ee.ExitStatus()
+		emitSSHEvent(sshEvent{Event: "exited", Addr: host, ExitCode: &code})
+		return remoteExitError{code: code}
+	}
+	return err
+}
+
+// nativeSSHDial dials host's port through tailscaled for runSSHNative.
+// It's a variable for tests.
+var nativeSSHDial = func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	return localClient.DialTCP(ctx, host, port)
+}
+
+// nativeSSHRemoteAddr returns the address runSSHNative connects to for
+// t, for the host key callback: t's host if it's an IP, or else its
+// peer's first Tailscale IP. knownhosts prefers the host name it's
+// also given, so a name that only tailscaled resolves, as for a host
+// behind a subnet router, gets the unspecified IPv4 address.
+func nativeSSHRemoteAddr(t *sshTarget, port uint16) *net.TCPAddr {
+	ip, err := netaddr.ParseIP(t.hostForSSH)
+	if err != nil && t.peer != nil && len(t.peer.TailscaleIPs) > 0 {
+		ip, err = t.peer.TailscaleIPs[0], nil
+	}
+	if err != nil {
+		ip = netaddr.IPv4(0, 0, 0, 0)
+	}
+	return netaddr.IPPortFrom(ip, port).TCPAddr()
+}
+
+// termGetSize is term.GetSize. It's a variable for tests.
+var termGetSize = term.GetSize
+
+// windowChanger is the part of *ssh.Session that forwardWindowSize
+// uses.
+type windowChanger interface {
+	WindowChange(h, w int) error
+}
+
+// sendWindowSize tells wc the size of the terminal fd if it's not w x
+// h, the size last sent, and returns the size now last sent.
+func sendWindowSize(wc windowChanger, fd, w, h int) (int, int) {
+	nw, nh, err := termGetSize(fd)
+	if err != nil || (nw == w && nh == h) {
+		return w, h
+	}
+	if err := wc.WindowChange(nh, nw); err != nil {
+		return w, h
+	}
+	return nw, nh
+}
+
+// nativeSSHAuthMethods returns the client auth methods to try.
+// Tailscale SSH servers usually accept the implicit "none" method,
+// which the Go client always tries first; these are for servers that
+// need a real key.
+//
+// If identityFiles is non-empty, only those keys are used (like
+// OpenSSH's IdentitiesOnly). Otherwise the ssh-agent's keys and the
+// default ~/.ssh/id_* keys are used.
+func nativeSSHAuthMethods(identityFiles []string) ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+	if len(identityFiles) > 0 {
+		for _, f := range identityFiles {
+			pem, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			s, err := ssh.ParsePrivateKey(pem)
+			if err != nil {
+				return nil, fmt.Errorf("identity file %q: %w", f, err)
+			}
+			signers = append(signers, s)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			if ss, err := agent.NewClient(c).Signers(); err == nil {
+				signers = append(signers, ss...)
+			}
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			pem, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			// Keys with a passphrase fail to parse here and
+			// are skipped; we don't prompt for passphrases.
+			if s, err := ssh.ParsePrivateKey(pem); err == nil {
+				signers = append(signers, s)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, nil
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
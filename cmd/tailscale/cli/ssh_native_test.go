@@ -0,0 +1,233 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// newTestSSHSigner returns a new ed25519 SSH host key.
+func newTestSSHSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serveTestSSH serves SSH on conn with hostKey and no client auth. Each
+// session's exec request writes the command, and a newline, to its
+// output and exits with status exitCode.
+func serveTestSSH(conn net.Conn, hostKey ssh.Signer, exitCode uint32) {
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range creqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				io.WriteString(ch, payload.Command+"\n")
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitCode}))
+				ch.Close()
+			}
+		}()
+	}
+}
+
+func TestRunSSHNative(t *testing.T) {
+	oldArgs, oldDial, oldStdin, oldStdout := sshArgs, nativeSSHDial, sshStdin, Stdout
+	defer func() { sshArgs, nativeSSHDial, sshStdin, Stdout = oldArgs, oldDial, oldStdin, oldStdout }()
+	sshArgs.noTTY = true
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	t.Setenv("HOME", t.TempDir()) // no ~/.ssh keys
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	hostKey := newTestSSHSigner(t)
+	knownHostsFile := filepath.Join(t.TempDir(), "ssh_known_hosts")
+	writeKnownHosts := func(key ssh.PublicKey) {
+		t.Helper()
+		if err := os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{"100.64.0.1"}, key)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dialed string
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(c, hostKey, 3)
+		}
+	}()
+	nativeSSHDial = func(ctx context.Context, host string, port uint16) (net.Conn, error) {
+		dialed = net.JoinHostPort(host, fmt.Sprint(port))
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	target := &sshTarget{hostForSSH: "100.64.0.1", knownHostsFile: knownHostsFile}
+
+	writeKnownHosts(hostKey.PublicKey())
+	var out bytes.Buffer
+	Stdout = &out
+	sshStdin = strings.NewReader("")
+	err = runSSHNative(context.Background(), "alice", target, "alice@web", []string{"echo", "hello  world"})
+	if !errors.Is(err, ErrRemoteExit) || ExitCode(err) != 3 {
+		t.Fatalf("got error %v (exit code %d); want ErrRemoteExit with exit code 3", err, ExitCode(err))
+	}
+	if dialed != "100.64.0.1:22" {
+		t.Errorf("dialed %q; want 100.64.0.1:22", dialed)
+	}
+	if got, want := out.String(), "echo hello  world\n"; got != want {
+		t.Errorf("remote command = %q; want %q", got, want)
+	}
+
+	// A host key other than known_hosts lists fails before running
+	// anything.
+	writeKnownHosts(newTestSSHSigner(t).PublicKey())
+	out.Reset()
+	err = runSSHNative(context.Background(), "alice", target, "alice@db", []string{"true"})
+	if err == nil || !strings.Contains(err.Error(), "knownhosts: key mismatch") {
+		t.Errorf("mismatched host key: got %v; want a key mismatch", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("mismatched host key: ran the command, printing %q", out.String())
+	}
+
+	// Only the connection that got through is in the history.
+	histFile, err := sshHistoryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hist, err := readSSHHistory(histFile); err != nil || !reflect.DeepEqual(hist, []string{"alice@web"}) {
+		t.Errorf("history = %q, %v; want just alice@web", hist, err)
+	}
+}
+
+func TestNativeSSHRemoteAddr(t *testing.T) {
+	peer := &ipnstate.PeerStatus{TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")}}
+	tests := []struct {
+		t    *sshTarget
+		want string
+	}{
+		{&sshTarget{hostForSSH: "100.64.0.1", peer: peer}, "100.64.0.1:2222"},
+		{&sshTarget{hostForSSH: "fd7a:115c:a1e0::1"}, "[fd7a:115c:a1e0::1]:2222"},
+		{&sshTarget{hostForSSH: "web", peer: peer}, "100.64.0.2:2222"},
+		{&sshTarget{hostForSSH: "db.corp.example"}, "0.0.0.0:2222"},
+	}
+	for _, tt := range tests {
+		if got := nativeSSHRemoteAddr(tt.t, 2222).String(); got != tt.want {
+			t.Errorf("nativeSSHRemoteAddr(%q) = %s; want %s", tt.t.hostForSSH, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNativeSSHFlags(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	lookErr := &exec.Error{Name: "ssh", Err: exec.ErrNotFound}
+	tests := []struct {
+		flag    string
+		set     func()
+		wantErr bool
+	}{
+		{"-o", func() { sshArgs.options = stringsFlag{"ServerAliveInterval=5"} }, true},
+		{"--local-command", func() { sshArgs.localCommand = "true" }, true},
+		{"--send-env", func() { sshArgs.sendEnv = stringsFlag{"FOO"} }, true},
+		{"--compression", func() { sshArgs.compression = true }, true},
+		{"--keepalive", func() { sshArgs.keepalive = true }, true},
+		{"--forward-agent", func() { sshArgs.forwardAgent = true }, true},
+		{"--batch", func() { sshArgs.batch = true }, false},
+		{"-v", func() { sshArgs.verbose = 1 }, false},
+		{"-q", func() { sshArgs.quiet = true }, false},
+		{"--no-compression", func() { sshArgs.noCompression = true }, false},
+	}
+	for _, tt := range tests {
+		sshArgs = oldArgs
+		tt.set()
+		err := checkNativeSSHFlags(lookErr)
+		if tt.wantErr && !errors.Is(err, ErrNoSSHBinary) {
+			t.Errorf("%s: got %v; want ErrNoSSHBinary", tt.flag, err)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: got %v; want nil", tt.flag, err)
+		}
+	}
+}
+
+type fakeWindowChanger struct{ sent [][2]int }
+
+func (f *fakeWindowChanger) WindowChange(h, w int) error {
+	f.sent = append(f.sent, [2]int{w, h})
+	return nil
+}
+
+func TestSendWindowSize(t *testing.T) {
+	oldGetSize := termGetSize
+	defer func() { termGetSize = oldGetSize }()
+
+	size := [2]int{80, 24}
+	termGetSize = func(int) (int, int, error) { return size[0], size[1], nil }
+	var wc fakeWindowChanger
+	w, h := sendWindowSize(&wc, 1, 80, 24)
+	if len(wc.sent) != 0 || w != 80 || h != 24 {
+		t.Errorf("unchanged size: sent %v, now %dx%d; want nothing sent", wc.sent, w, h)
+	}
+	size = [2]int{120, 40}
+	w, h = sendWindowSize(&wc, 1, w, h)
+	if len(wc.sent) != 1 || wc.sent[0] != size || w != 120 || h != 40 {
+		t.Errorf("resized: sent %v, now %dx%d; want [[120 40]] sent", wc.sent, w, h)
+	}
+	termGetSize = func(int) (int, int, error) { return 0, 0, errors.New("not a terminal") }
+	if w, h = sendWindowSize(&wc, 1, w, h); len(wc.sent) != 1 || w != 120 || h != 40 {
+		t.Errorf("GetSize error: sent %v, now %dx%d; want nothing more sent", wc.sent, w, h)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build js || windows
+// +build js windows
+
+package cli
+
+import "time"
+
+// forwardWindowSize tells wc, a session with a w x h pty, the new size
+// of the terminal fd each time it's resized, until the returned stop
+// func is called. There's no SIGWINCH here, so it polls.
+func forwardWindowSize(wc windowChanger, fd, w, h int) (stop func()) {
+	t := time.NewTicker(250 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-t.C:
+				w, h = sendWindowSize(wc, fd, w, h)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(done)
+	}
+}
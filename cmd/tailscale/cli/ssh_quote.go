@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"fmt"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// sshQuotePath quotes the file path p for the value of an ssh option,
+// such as UserKnownHostsFile.
+func sshQuotePath(p string) string {
+	return fmt.Sprintf("%q", p)
+}
+
+// sshQuoteCommandArg quotes s as a word of a ProxyCommand, which ssh
+// runs with the shell.
+func sshQuoteCommandArg(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+// sshJoinCommand joins args into a ProxyCommand.
+func sshJoinCommand(args ...string) string {
+	return shellquote.Join(args...)
+}
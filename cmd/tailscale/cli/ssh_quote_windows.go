@@ -0,0 +1,38 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sshQuotePath quotes the file path p for the value of an ssh option,
+// such as UserKnownHostsFile.
+//
+// OpenSSH's option parser takes backslashes in quoted values as
+// escapes, so they're replaced with forward slashes, which Windows
+// accepts in paths too. Windows paths can't contain double quotes.
+func sshQuotePath(p string) string {
+	return `"` + filepath.ToSlash(p) + `"`
+}
+
+// sshQuoteCommandArg quotes s as a word of a ProxyCommand. OpenSSH for
+// Windows starts it as a Windows command line rather than with a POSIX
+// shell, so s is quoted by the Windows rules, in which backslashes (as
+// in paths and in tailscaled's named pipe) are literal.
+func sshQuoteCommandArg(s string) string {
+	return syscall.EscapeArg(s)
+}
+
+// sshJoinCommand joins args into a ProxyCommand.
+func sshJoinCommand(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = sshQuoteCommandArg(a)
+	}
+	return strings.Join(quoted, " ")
+}
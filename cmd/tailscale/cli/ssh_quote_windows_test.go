@@ -0,0 +1,42 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSHOptionsWindowsPaths(t *testing.T) {
+	knownHosts := `C:\Users\Jo Smith\AppData\Roaming\tailscale\ssh_known_hosts`
+	bin := `C:\Program Files\Tailscale\tailscale.exe`
+	socket := `\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled`
+
+	proxyCommand, err := sshProxyCommand(bin, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProxy := `"C:\Program Files\Tailscale\tailscale.exe" --socket=\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled nc %h %p`
+	if proxyCommand != wantProxy {
+		t.Errorf("ProxyCommand = %s; want %s", proxyCommand, wantProxy)
+	}
+
+	got := sshHostOptions(knownHosts, proxyCommand)
+	want := []string{
+		"-o", `UserKnownHostsFile "C:/Users/Jo Smith/AppData/Roaming/tailscale/ssh_known_hosts"`,
+		"-o", "UpdateHostKeys no",
+		"-o", "StrictHostKeyChecking yes",
+		"-o", "ProxyCommand " + wantProxy,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sshHostOptions =\n%q\nwant\n%q", got, want)
+	}
+
+	jump := sshJumpProxyCommand(`C:\Windows\System32\OpenSSH\ssh.exe`, "jump", knownHosts, proxyCommand)
+	wantJump := `C:\Windows\System32\OpenSSH\ssh.exe -o "UserKnownHostsFile \"C:/Users/Jo Smith/AppData/Roaming/tailscale/ssh_known_hosts\"" -o "UpdateHostKeys no" -o "StrictHostKeyChecking yes" -o "ProxyCommand \"C:\Program Files\Tailscale\tailscale.exe\" --socket=\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled nc %%h %%p" -W [%h]:%p jump`
+	if jump != wantJump {
+		t.Errorf("jump ProxyCommand =\n%s\nwant\n%s", jump, wantJump)
+	}
+}
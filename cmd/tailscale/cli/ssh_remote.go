@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	shellquote "github.com/kballard/go-shellquote"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// RunRemote runs cmd on the tailnet peer userHost ("[user@]host", as
+// for "tailscale ssh") using the system ssh, set up as "tailscale ssh"
+// sets it up (with the known_hosts file of peers' host keys and a
+// ProxyCommand through tailscaled), and returns its output.
+//
+// Unlike on the ssh command line, each element of cmd reaches the
+// remote command as one argument: they're quoted for the remote user's
+// shell, which runs the command. So {"echo", "hello  world"} prints
+// "hello  world". It never prompts, and doesn't allocate a terminal.
+//
+// A non-zero exitCode with a nil error is the remote command's (or
+// ssh's, which uses 255 for its own failures) exit status; err is for
+// failing to run ssh at all, or for ctx ending before it finished.
+func RunRemote(ctx context.Context, userHost string, cmd []string) (stdout, stderr []byte, exitCode int, err error) {
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return nil, nil, 0, sshStatusError(err)
+	}
+	return runRemote(ctx, st, userHost, cmd)
+}
+
+func runRemote(ctx context.Context, st *ipnstate.Status, userHost string, cmd []string) (stdout, stderr []byte, exitCode int, err error) {
+	if len(cmd) == 0 {
+		return nil, nil, 0, errors.New("RunRemote: no command")
+	}
+	username, host, port, err := parseSSHDestination(userHost)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if username == "" {
+		if username, err = sshDefaultUsername(); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	peer, hostForSSH, err := resolvePeer(st, host)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if peer == nil {
+		return nil, nil, 0, withKind(ErrPeerNotFound, fmt.Errorf("%q is not a peer in your tailnet", host))
+	}
+	if err := checkSSHPeer(peer, true); err != nil && !errors.Is(err, errPeerOffline) {
+		return nil, nil, 0, err
+	}
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, nil, 0, withKind(ErrNoSSHBinary, fmt.Errorf("no system 'ssh' command found: %w", err))
+	}
+	tailscaleBin, err := sshTailscaleBin()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	proxyCommand, err := sshProxyCommand(tailscaleBin, sshSocket())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	knownHostsFile, err := writeKnownHosts(st, KnownHostsOptions{Targets: []*ipnstate.PeerStatus{peer}, Port: port})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	args := sshHostOptions(knownHostsFile, proxyCommand)
+	args = append(args, "-o", "BatchMode yes", "-T")
+	if port != 0 {
+		args = append(args, "-p", fmt.Sprint(port))
+	}
+	args = append(args, username+"@"+hostForSSH, "--")
+	args = append(args, shellquote.Join(cmd...))
+
+	var outBuf, errBuf bytes.Buffer
+	c := exec.CommandContext(ctx, ssh, args...)
+	c.Stdout = &outBuf
+	c.Stderr = &errBuf
+	err = c.Run()
+	if ctx.Err() != nil {
+		// ssh was killed, so its exit status is meaningless.
+		return nil, nil, 0, ctx.Err()
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return outBuf.Bytes(), errBuf.Bytes(), ee.ExitCode(), nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), 0, nil
+}
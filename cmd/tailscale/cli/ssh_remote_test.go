@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestRunRemote(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ssh is a shell script")
+	}
+	binDir := t.TempDir()
+	fakeSSH := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done\necho oops >&2\nexit 3\n"
+	if err := os.WriteFile(filepath.Join(binDir, "ssh"), []byte(fakeSSH), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", filepath.Join(t.TempDir(), "state"))
+	oldSocket := sshArgs.socket
+	defer func() { sshArgs.socket = oldSocket }()
+	sshArgs.socket = "/tmp/tailscaled.sock"
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+	stdout, stderr, code, err := runRemote(context.Background(), st, "alice@web", []string{"echo", "hello  world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Errorf("exit code = %d; want 3", code)
+	}
+	if got := string(stderr); got != "oops\n" {
+		t.Errorf("stderr = %q; want %q", got, "oops\n")
+	}
+	if want := "alice@100.64.0.1\n--\necho 'hello  world'\n"; !strings.HasSuffix(string(stdout), want) {
+		t.Errorf("ssh args:\n%s\nwant them to end with:\n%s", stdout, want)
+	}
+	if !strings.Contains(string(stdout), "BatchMode yes") {
+		t.Errorf("ssh args:\n%s\nwant BatchMode", stdout)
+	}
+
+	if _, _, _, err := runRemote(context.Background(), st, "nosuchpeer", []string{"true"}); err == nil {
+		t.Error("unknown peer: got nil error")
+	}
+}
+
+func TestRunRemoteCanceled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ssh is a shell script")
+	}
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "ssh"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", filepath.Join(t.TempDir(), "state"))
+	oldSocket := sshArgs.socket
+	defer func() { sshArgs.socket = oldSocket }()
+	sshArgs.socket = "/tmp/tailscaled.sock"
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, code, err := runRemote(ctx, st, "alice@web", []string{"true"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got exit code %d, err %v; want %v", code, err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// runSSHResolve implements "tailscale ssh --resolve <host>", printing
+// the peer that host resolves to, as "tailscale ssh <host>" would
+// resolve it, and whether it runs Tailscale SSH. A glob pattern for
+// host, as in "web-*", prints every peer it matches (see
+// matchPeerPattern) instead. It doesn't connect.
+func runSSHResolve(ctx context.Context, arg string) error {
+	st, err := sshStatus(ctx)
+	if err != nil {
+		return sshStatusError(err)
+	}
+	return printSSHResolve(Stdout, st, arg)
+}
+
+// printSSHResolve writes to w what the "[user@]host" argument arg
+// resolves to in st. It's an error, with nothing written, if arg
+// matches no peer (or this node).
+func printSSHResolve(w io.Writer, st *ipnstate.Status, arg string) error {
+	_, host, _, err := parseSSHDestination(arg)
+	if err != nil {
+		return err
+	}
+	if isPeerPattern(host) {
+		return printSSHResolvePattern(w, st, host)
+	}
+	ps, err := peerFromArg(st, host)
+	if err != nil {
+		return err
+	}
+	if ps == nil && isSelfHost(st, host) {
+		ps = st.Self
+	}
+	if ps == nil {
+		if sug, ok := suggestPeerName(st, host); ok {
+			return withKind(ErrPeerNotFound, fmt.Errorf("no peer %q; did you mean %q?", host, sug))
+		}
+		return withKind(ErrPeerNotFound, fmt.Errorf("%q is not a peer in your tailnet", host))
+	}
+	printSSHResolvePeer(w, ps)
+	return nil
+}
+
+// printSSHResolvePattern writes to w each of the peers in st that
+// pattern matches, sorted by name and separated by blank lines. It's an
+// error, with nothing written, if it matches none.
+func printSSHResolvePattern(w io.Writer, st *ipnstate.Status, pattern string) error {
+	var peers []*ipnstate.PeerStatus
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		ok, err := matchPeerPattern(pattern, ps)
+		if err != nil {
+			return err
+		}
+		if ok {
+			peers = append(peers, ps)
+		}
+	}
+	if len(peers) == 0 {
+		return withKind(ErrPeerNotFound, fmt.Errorf("no peers match %q", pattern))
+	}
+	ipnstate.SortPeers(peers)
+	for i, ps := range peers {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		printSSHResolvePeer(w, ps)
+	}
+	return nil
+}
+
+func printSSHResolvePeer(w io.Writer, ps *ipnstate.PeerStatus) {
+	ips := make([]string, len(ps.TailscaleIPs))
+	for i, ip := range ps.TailscaleIPs {
+		ips[i] = ip.String()
+	}
+	fmt.Fprintf(w, "DNSName:       %s\n", strings.TrimSuffix(ps.DNSName, "."))
+	fmt.Fprintf(w, "TailscaleIPs:  %s\n", strings.Join(ips, ", "))
+	fmt.Fprintf(w, "Online:        %v\n", ps.Online)
+	fmt.Fprintf(w, "SSH host keys: %d\n", len(ps.SSH_HostKeys))
+}
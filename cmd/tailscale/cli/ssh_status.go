@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// sshStatus returns tailscaled's Status for "tailscale ssh", retrying
+// once if the call fails in a way that's likely transient; see
+// withStatusRetry.
+//
+// It's fetched afresh each time, not cached: nothing short of the full
+// Status changes when the netmap does, so a cache would miss peers
+// coming online or rotating host keys, and a stale host key in the
+// generated known_hosts fails the connection.
+func sshStatus(ctx context.Context) (*ipnstate.Status, error) {
+	return withStatusRetry(ctx, localClient.Status)
+}
+
+// statusRetryDelay is how long withStatusRetry waits before retrying.
+var statusRetryDelay = 250 * time.Millisecond
+
+// withStatusRetry returns get(ctx), calling it a second time, after
+// statusRetryDelay, if the first call failed with a transient error:
+// the connection to tailscaled was closed or reset mid-request, as can
+// happen right after tailscaled restarts. Errors meaning tailscaled
+// isn't running at all, such as a refused dial, aren't retried.
+func withStatusRetry(ctx context.Context, get func(context.Context) (*ipnstate.Status, error)) (*ipnstate.Status, error) {
+	st, err := get(ctx)
+	if err == nil || !isTransientStatusError(err) {
+		return st, err
+	}
+	t := time.NewTimer(statusRetryDelay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, err
+	case <-t.C:
+	}
+	return get(ctx)
+}
+
+func isTransientStatusError(err error) bool {
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
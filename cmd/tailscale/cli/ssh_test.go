@@ -0,0 +1,3347 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go4.org/mem"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+func TestSSHProxyCommandSocket(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("no ProxyCommand on macOS")
+	}
+	oldArgs, oldRoot := sshArgs, rootArgs.socket
+	defer func() { sshArgs, rootArgs.socket = oldArgs, oldRoot }()
+
+	rootArgs.socket = "/var/run/tailscale/tailscaled.sock"
+	if err := sshCmd.FlagSet.Parse([]string{"--socket=/tmp/other tailscaled.sock", "host"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sshProxyCommand("/usr/bin/tailscale", sshSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `--socket="/tmp/other tailscaled.sock" nc %h %p`
+	if !strings.Contains(got, want) {
+		t.Errorf("ProxyCommand = %q; want it to contain %q", got, want)
+	}
+	if strings.Contains(got, rootArgs.socket) {
+		t.Errorf("ProxyCommand = %q; still uses root --socket", got)
+	}
+}
+
+func TestCheckSSHPeer(t *testing.T) {
+	tests := []struct {
+		name            string
+		ps              *ipnstate.PeerStatus
+		requireHostKeys bool
+		wantErr         string
+	}{
+		{
+			name:            "ok",
+			ps:              &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKey}},
+			requireHostKeys: true,
+		},
+		{
+			name:            "offline",
+			ps:              &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", SSH_HostKeys: []string{testHostKey}},
+			requireHostKeys: true,
+			wantErr:         "web.foo.ts.net is offline",
+		},
+		{
+			name:            "no-ssh",
+			ps:              &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true},
+			requireHostKeys: true,
+			wantErr:         "Tailscale SSH isn't enabled",
+		},
+		{
+			name: "no-ssh-own-known-hosts",
+			ps:   &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSSHPeer(tt.ps, tt.requireHostKeys)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Host keys for tests. Only keys that parse make it into known_hosts, so
+// these are real (if otherwise meaningless) public keys.
+const (
+	testHostKey      = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINz62LVC1JOu0Bxorow6SqEY/xUDp/Rfe9eRko+eedHU"
+	testHostKey2     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO2g/7OICtgUcj5WUbFqScfssFeIgNrinEajF9BDP9pz"
+	testHostKey3     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEZBts82xcDWMuQzrJilGNyR6F1JqNIWg/z8Rc82Hazw"
+	testHostKey4     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ7oRepHB+SB/DZG5tpyBqt83FH7yu183NNh6iO2gII2"
+	testHostKeyOn    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILePtxt1UXY6qGgrWla0R62AjpLszprlcBtd1QWPCFeX"
+	testHostKeyOff   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBwxcyFWNfgMmlV1XyE1OAH/V44k/myM+0VT0K6RvJtx"
+	testHostKeyMe    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPKW7Z7Lk/bWYUVZo3IBBqBsrOj5yjCpk29BQp4NXhwv"
+	testHostKeyDB    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILlvhAM8HoWBbADWpwpGG0QvDIH0gsAV7VHT9dkjGnjP"
+	testHostKeyWeb   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFaIIZs0LRJCH0sJG4d6UxOFXprBkB/SgAxQwjEtwbQw"
+	testHostCAKey    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGauB+GzHtQSTYw65mIPVEmnmhgP3fW+vV5WcTu0qaBV"
+	testHostKeyOld   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDHmCffYaRMq+WJ65VbMGwSlWCLUWFjrUkf86IFqc50F"
+	testHostKeyNew   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGdSc3nWrG2yyrUmdmHgIYG+sM0as8akqEP9z+1qCDzW"
+	testHostKeyRSA   = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDZ8iNS3g2dBRkxdYjkTH5rujOswbRTBQjOgnKl9RWcW2c+PNzcSaVzFNZxeEAwycOCL6txaTkuefWZZl/G6I2EFPeDrV7ZZCGVCbqb+/iFUrGsTy2efT9vKQ6UYGxBiF6IGd67ipxLHm6/adYZsdrgGTL+eItfRnssGtyRxKh4WQ=="
+	testHostKeyECDSA = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBJULLYQVQso44p+xoVWcnMIOJVXIUFMbCOUhw9fOBwz1Vmz3nBNGJWKuj8dGpTXpGBwqWuJvUo7vU0rb4XMrL+c="
+)
+
+func testNodeKey(b byte) key.NodePublic {
+	var bs [key.NodePublicRawLen]byte
+	bs[0] = b
+	return key.NodePublicFromRaw32(mem.B(bs[:]))
+}
+
+// knownHostsString returns KnownHostsForStatus(st, opts) as a string,
+// failing t if any host keys were skipped as malformed.
+func knownHostsString(t *testing.T, st *ipnstate.Status, opts KnownHostsOptions) string {
+	t.Helper()
+	kh, skipped := KnownHostsForStatus(st, opts)
+	for _, err := range skipped {
+		t.Errorf("KnownHostsForStatus: %v", err)
+	}
+	return string(kh)
+}
+
+func TestGenKnownHostsDedup(t *testing.T) {
+	ip := netaddr.MustParseIP("100.64.0.1")
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "100.64.0.1",
+				TailscaleIPs: []netaddr.IP{ip, ip},
+				SSH_HostKeys: []string{testHostKey, testHostKey + " ", testHostKeyRSA},
+			},
+			testNodeKey(2): {
+				DNSName:      "100.64.0.1",
+				TailscaleIPs: []netaddr.IP{ip},
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+	for _, hash := range []bool{false, true} {
+		got := knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true, Hash: hash})
+		lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+		if len(lines) != 2 {
+			t.Errorf("hash=%v: got %d lines; want 2:\n%s", hash, len(lines), got)
+		}
+		if !hash {
+			want := "100.64.0.1 " + testHostKey + "\n100.64.0.1 " + testHostKeyRSA + "\n"
+			if got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		}
+	}
+}
+
+func TestResolvePeerIPv6(t *testing.T) {
+	v4 := netaddr.MustParseIP("100.64.0.1")
+	v6 := netaddr.MustParseIP("fd7a:115c:a1e0::1")
+	peer := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{v4, v6},
+		SSH_HostKeys: []string{testHostKey},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): peer},
+	}
+	tests := []struct {
+		arg      string
+		wantHost string
+		wantPeer bool
+	}{
+		{"fd7a:115c:a1e0::1", "100.64.0.1", true},
+		{"[fd7a:115c:a1e0::1]", "100.64.0.1", true},
+		{"fd00::9", "fd00::9", false},
+		{"[fd00::9]", "fd00::9", false},
+	}
+	for _, tt := range tests {
+		ps, host, err := resolvePeer(st, tt.arg)
+		if err != nil {
+			t.Errorf("resolvePeer(%q): %v", tt.arg, err)
+			continue
+		}
+		if host != tt.wantHost || (ps != nil) != tt.wantPeer {
+			t.Errorf("resolvePeer(%q) = peer=%v, %q; want peer=%v, %q", tt.arg, ps != nil, host, tt.wantPeer, tt.wantHost)
+		}
+	}
+
+	kh := knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true})
+	if want := "web.foo.ts.net,web,100.64.0.1,fd7a:115c:a1e0::1 " + testHostKey + "\n"; kh != want {
+		t.Errorf("known_hosts = %q; want %q", kh, want)
+	}
+}
+
+func TestSSHDefaultUsername(t *testing.T) {
+	old := userCurrent
+	defer func() { userCurrent = old }()
+	userCurrent = func() (*user.User, error) { return nil, errors.New("no passwd entry") }
+
+	t.Setenv("USER", "")
+	t.Setenv("LOGNAME", "")
+	if name, err := sshDefaultUsername(); err == nil {
+		t.Fatalf("got %q, nil error; want error", name)
+	}
+
+	t.Setenv("LOGNAME", "alice")
+	name, err := sshDefaultUsername()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "alice" {
+		t.Errorf("got %q; want %q", name, "alice")
+	}
+}
+
+func TestGenKnownHostsNames(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+	got := knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true})
+	want := "db.foo.ts.net,db,100.64.0.2 " + testHostKey + "\n"
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestSSHTailscaleBinOverride(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("no ProxyCommand on macOS")
+	}
+	old := sshArgs.tailscaleBin
+	defer func() { sshArgs.tailscaleBin = old }()
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "tailscale")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sshArgs.tailscaleBin = bin
+	got, err := sshTailscaleBin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc, err := sshProxyCommand(got, "/tmp/tailscaled.sock"); err != nil || !strings.HasPrefix(pc, fmt.Sprintf("%q ", bin)) {
+		t.Errorf("ProxyCommand = %q, %v; want it to run %q", pc, err, bin)
+	}
+
+	sshArgs.tailscaleBin = filepath.Join(dir, "missing")
+	if _, err := sshTailscaleBin(); err == nil {
+		t.Error("missing binary: got nil error")
+	}
+	if runtime.GOOS != "windows" {
+		notExec := filepath.Join(dir, "notexec")
+		if err := os.WriteFile(notExec, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sshArgs.tailscaleBin = notExec
+		if _, err := sshTailscaleBin(); err == nil {
+			t.Error("non-executable binary: got nil error")
+		}
+	}
+}
+
+func TestGenKnownHostsMalformed(t *testing.T) {
+	var stderr bytes.Buffer
+	oldStderr := Stderr
+	Stderr = &stderr
+	defer func() { Stderr = oldStderr }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				SSH_HostKeys: []string{
+					testHostKey,
+					"ssh-rsa BBBB\nevil.example.com ssh-rsa CCCC",
+					"ssh-rsa DD\rDD",
+					" ",
+				},
+			},
+		},
+	}
+	kh, skipped := KnownHostsForStatus(st, KnownHostsOptions{IncludeOffline: true})
+	if got, want := string(kh), "web.foo.ts.net,web,100.64.0.1 "+testHostKey+"\n"; got != want {
+		t.Errorf("known_hosts = %q; want %q", got, want)
+	}
+	const wantSkipped = "skipped 3 malformed host key(s) for peer web.foo.ts.net"
+	if len(skipped) != 1 || skipped[0].Error() != wantSkipped {
+		t.Errorf("skipped = %q; want [%q]", skipped, wantSkipped)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("KnownHostsForStatus printed %q; want it left to the caller", stderr.String())
+	}
+
+	// Writing the file warns about them.
+	oldDir := sshArgs.knownHostsDir
+	defer func() { sshArgs.knownHostsDir = oldDir }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	if _, err := writeKnownHosts(st, KnownHostsOptions{IncludeOffline: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "Warning: "+wantSkipped) {
+		t.Errorf("writeKnownHosts: stderr = %q; want it to contain %q", stderr.String(), wantSkipped)
+	}
+}
+
+func TestGenKnownHostsInvalidKeys(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				SSH_HostKeys: []string{
+					"not a host key",
+					"ssh-ed25519 AAAA",
+					testHostKey + " root@web",
+					`command="evil" ` + testHostKey2,
+				},
+			},
+		},
+	}
+	kh, skipped := KnownHostsForStatus(st, KnownHostsOptions{IncludeOffline: true})
+	want := "web.foo.ts.net,web,100.64.0.1 " + testHostKey + "\n" +
+		"web.foo.ts.net,web,100.64.0.1 " + testHostKey2 + "\n"
+	if got := string(kh); got != want {
+		t.Errorf("known_hosts = %q; want %q", got, want)
+	}
+	if want := "skipped 2 malformed host key(s) for peer web.foo.ts.net"; len(skipped) != 1 || skipped[0].Error() != want {
+		t.Errorf("skipped = %q; want [%q]", skipped, want)
+	}
+}
+
+func TestParseSSHDestination(t *testing.T) {
+	tests := []struct {
+		arg      string
+		wantUser string
+		wantHost string
+		wantPort int
+		wantErr  bool
+	}{
+		{arg: "web", wantHost: "web"},
+		{arg: "alice@web", wantUser: "alice", wantHost: "web"},
+		{arg: "ssh://alice@web:2222", wantUser: "alice", wantHost: "web", wantPort: 2222},
+		{arg: "ssh://web", wantHost: "web"},
+		{arg: "ssh://bob@[fd7a:115c:a1e0::1]:22/", wantUser: "bob", wantHost: "fd7a:115c:a1e0::1", wantPort: 22},
+		{arg: "ssh://web:99999", wantErr: true},
+		{arg: "ssh://web/some/path", wantErr: true},
+		{arg: "ssh://", wantErr: true},
+	}
+	for _, tt := range tests {
+		user, host, port, err := parseSSHDestination(tt.arg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got nil error", tt.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.arg, err)
+			continue
+		}
+		if user != tt.wantUser || host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("%q = %q, %q, %d; want %q, %q, %d", tt.arg, user, host, port, tt.wantUser, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+func TestWriteKnownHostsKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir) // Unix
+	t.Setenv("HOME", dir)            // macOS
+	t.Setenv("AppData", dir)         // Windows
+
+	ps := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		Online:       true,
+		SSH_HostKeys: []string{testHostKeyOld},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): ps},
+	}
+	if _, err := writeKnownHosts(st, KnownHostsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ps.SSH_HostKeys = []string{testHostKeyNew}
+	f, err := writeKnownHosts(st, KnownHostsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), testHostKeyOld) {
+		t.Errorf("old host key still present after rotation:\n%s", got)
+	}
+	if want := "# peer web.foo.ts.net\nweb.foo.ts.net,web,100.64.0.1 " + testHostKeyNew + "\n"; string(got) != want {
+		t.Errorf("known_hosts = %q; want %q", got, want)
+	}
+}
+
+func TestSSHUserOptions(t *testing.T) {
+	got, err := sshUserOptions([]string{"ServerAliveInterval=30", "requesttty force"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-o", "ServerAliveInterval 30", "-o", "RequestTTY force"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	for _, bad := range []string{"ProxyCommand=nc evil 22", "ServerAliveInterval", "=30", "LogLevel=DEBUG\nProxyCommand x"} {
+		if _, err := sshUserOptions([]string{bad}); err == nil {
+			t.Errorf("-o %q: got nil error", bad)
+		}
+	}
+	_, err = sshUserOptions([]string{"ProxyCommand=nc evil 22"})
+	if err == nil || !strings.Contains(err.Error(), "ServerAliveInterval") {
+		t.Errorf("error %v doesn't name the allowed options", err)
+	}
+}
+
+func TestSSHStatusError(t *testing.T) {
+	oldVerbose := sshArgs.verbose
+	defer func() { sshArgs.verbose = oldVerbose }()
+
+	dialErr := fmt.Errorf("Failed to connect to local Tailscale daemon for /localapi/v0/status; Error: %w",
+		&net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED})
+
+	sshArgs.verbose = 0
+	err := sshStatusError(dialErr)
+	if !strings.Contains(err.Error(), "failed to connect to local") {
+		t.Errorf("got %q; want a friendly tailscaled-not-running error", err)
+	}
+
+	sshArgs.verbose = 1
+	err = sshStatusError(dialErr)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("with --verbose, got %q; want it to wrap the original error", err)
+	}
+
+	other := errors.New("some other error")
+	if err := sshStatusError(other); err != other {
+		t.Errorf("got %v; want unchanged %v", err, other)
+	}
+}
+
+func TestSSHTTYOptions(t *testing.T) {
+	oldTTY, oldNoTTY := sshArgs.tty, sshArgs.noTTY
+	defer func() { sshArgs.tty, sshArgs.noTTY = oldTTY, oldNoTTY }()
+
+	tests := []struct {
+		tty, noTTY bool
+		want       []string
+	}{
+		{want: nil},
+		{tty: true, want: []string{"-o", "RequestTTY force"}},
+		{noTTY: true, want: []string{"-o", "RequestTTY no"}},
+	}
+	for _, tt := range tests {
+		sshArgs.tty, sshArgs.noTTY = tt.tty, tt.noTTY
+		if got := sshTTYOptions(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tty=%v noTTY=%v: got %q; want %q", tt.tty, tt.noTTY, got, tt.want)
+		}
+	}
+}
+
+func TestGenKnownHostsKeyOrder(t *testing.T) {
+	gen := func(keys ...string) []byte {
+		st := &ipnstate.Status{
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				testNodeKey(1): {
+					DNSName:      "web.foo.ts.net.",
+					TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+					SSH_HostKeys: keys,
+				},
+			},
+		}
+		kh, _ := KnownHostsForStatus(st, KnownHostsOptions{IncludeOffline: true})
+		return kh
+	}
+	a := gen(testHostKeyRSA, testHostKey, testHostKeyECDSA)
+	b := gen(testHostKeyECDSA, testHostKey, testHostKeyRSA)
+	if !bytes.Equal(a, b) {
+		t.Errorf("output depends on key order:\n%s\nvs\n%s", a, b)
+	}
+	want := "" +
+		"web.foo.ts.net,web,100.64.0.1 " + testHostKeyECDSA + "\n" +
+		"web.foo.ts.net,web,100.64.0.1 " + testHostKey + "\n" +
+		"web.foo.ts.net,web,100.64.0.1 " + testHostKeyRSA + "\n"
+	if string(a) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", a, want)
+	}
+}
+
+func TestWriteKnownHostsDir(t *testing.T) {
+	old := sshArgs.knownHostsDir
+	defer func() { sshArgs.knownHostsDir = old }()
+
+	st := &ipnstate.Status{}
+	dir := filepath.Join(t.TempDir(), "env")
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", dir)
+	f, err := writeKnownHosts(st, KnownHostsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "ssh_known_hosts"); f != want {
+		t.Errorf("with env knob, got %q; want %q", f, want)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm() != 0700 {
+		t.Errorf("dir mode = %v; want 0700", fi.Mode().Perm())
+	}
+
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "flag")
+	f, err = writeKnownHosts(st, KnownHostsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(sshArgs.knownHostsDir, "ssh_known_hosts"); f != want {
+		t.Errorf("with flag, got %q; want %q", f, want)
+	}
+}
+
+func TestWriteKnownHostsOmitShortNamesFile(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	web := &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKeyWeb}}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): web},
+	}
+	plain, err := writeKnownHosts(st, sshKnownHostsOptions(web))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshArgs.omitShortNames = true
+	fqdn, err := writeKnownHosts(st, sshKnownHostsOptions(web))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(sshArgs.knownHostsDir, "ssh_known_hosts_fqdn"); fqdn != want {
+		t.Errorf("with --omit-short-names, file = %q; want %q", fqdn, want)
+	}
+	// The other runs' file keeps its short names.
+	if kh := string(mustReadFile(t, plain)); !strings.Contains(kh, "web.foo.ts.net,web ") {
+		t.Errorf("%s lost its short names:\n%s", plain, kh)
+	}
+	if kh := string(mustReadFile(t, fqdn)); strings.Contains(kh, ",web ") {
+		t.Errorf("%s has short names:\n%s", fqdn, kh)
+	}
+
+	// So do --hash-known-hosts runs, which would otherwise flip the
+	// file between hashed and plain.
+	sshArgs.hashKnownHosts = true
+	hashed, err := writeKnownHosts(st, sshKnownHostsOptions(web))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(sshArgs.knownHostsDir, "ssh_known_hosts_fqdn_hashed"); hashed != want {
+		t.Errorf("with --omit-short-names --hash-known-hosts, file = %q; want %q", hashed, want)
+	}
+	sshArgs.omitShortNames = false
+	if f := knownHostsFileName(sshKnownHostsOptions(web)); f != "ssh_known_hosts_hashed" {
+		t.Errorf("with --hash-known-hosts, file = %q; want ssh_known_hosts_hashed", f)
+	}
+	if kh := string(mustReadFile(t, fqdn)); !strings.Contains(kh, "web.foo.ts.net ") {
+		t.Errorf("%s was hashed:\n%s", fqdn, kh)
+	}
+	if kh := string(mustReadFile(t, hashed)); !strings.HasPrefix(kh, "|1|") {
+		t.Errorf("%s isn't hashed:\n%s", hashed, kh)
+	}
+}
+
+func TestMakeSSHStateDir(t *testing.T) {
+	old := sshArgs.knownHostsDir
+	defer func() { sshArgs.knownHostsDir = old }()
+	var stderr bytes.Buffer
+	oldStderr := Stderr
+	Stderr = &stderr
+	defer func() { Stderr = oldStderr }()
+
+	// A file in the way.
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(sshArgs.knownHostsDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeSSHStateDir(); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("file in the way: got %v; want a not-a-directory error", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return // no Unix permissions
+	}
+	// Loose permissions.
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "loose")
+	if err := os.Mkdir(sshArgs.knownHostsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeSSHStateDir(); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("0700 dir: got warning %q; want none", stderr.String())
+	}
+	if err := os.Chmod(sshArgs.knownHostsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := makeSSHStateDir(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "accessible by other users") {
+		t.Errorf("0755 dir: got warning %q; want one about other users", stderr.String())
+	}
+}
+
+func TestSSHCompressionOptions(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	relayed := &ipnstate.PeerStatus{Relay: "nyc"}
+	direct := &ipnstate.PeerStatus{Relay: "nyc", CurAddr: "192.168.1.2:41641"}
+	yes := []string{"-o", "Compression yes"}
+	no := []string{"-o", "Compression no"}
+	tests := []struct {
+		name          string
+		ps            *ipnstate.PeerStatus
+		compression   bool
+		noCompression bool
+		options       []string
+		want          []string
+	}{
+		{name: "relayed", ps: relayed, want: yes},
+		{name: "direct", ps: direct, want: nil},
+		{name: "non-peer", ps: nil, want: nil},
+		{name: "relayed-no-compression", ps: relayed, noCompression: true, want: no},
+		{name: "direct-compression", ps: direct, compression: true, want: yes},
+		{name: "relayed-user-option", ps: relayed, options: []string{"compression=no"}, want: nil},
+	}
+	for _, tt := range tests {
+		sshArgs.compression, sshArgs.noCompression, sshArgs.options = tt.compression, tt.noCompression, tt.options
+		if got := sshCompressionOptions(tt.ps); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSSHErrorKinds(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "webserver.foo.ts.net.", Online: true},
+		},
+	}
+	lookErr := &exec.Error{Name: "ssh", Err: exec.ErrNotFound}
+	sshArgs.jump = "bastion"
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no-ssh-binary", checkNativeSSHFlags(lookErr), ErrNoSSHBinary},
+		{"typo", sshPeerNotFoundError(st, "webservr", false), ErrPeerNotFound},
+		{"strict", sshPeerNotFoundError(st, "example.com", true), ErrPeerNotFound},
+		{"ssh-not-enabled", checkSSHPeer(st.Peer[testNodeKey(1)], true), ErrSSHNotEnabled},
+		{"tailscaled-unreachable", sshStatusError(&net.OpError{Op: "dial", Err: syscall.ENOENT}), ErrTailscaledUnreachable},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s: error %v doesn't match %v", tt.name, tt.err, tt.want)
+		}
+	}
+	if !errors.Is(checkNativeSSHFlags(lookErr), exec.ErrNotFound) {
+		t.Error("ErrNoSSHBinary error doesn't still wrap the underlying error")
+	}
+	if err := sshPeerNotFoundError(st, "example.com", false); err != nil {
+		t.Errorf("non-peer host: got %v; want nil", err)
+	}
+}
+
+func TestSSHExitCode(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "webserver.foo.ts.net.", Online: true},
+		},
+	}
+	lookErr := &exec.Error{Name: "ssh", Err: exec.ErrNotFound}
+	sshArgs.jump = "bastion"
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"other", errors.New("boom"), 1},
+		{"peer-not-found", sshPeerNotFoundError(st, "webservr", false), 3},
+		{"ssh-not-enabled", checkSSHPeer(st.Peer[testNodeKey(1)], true), 4},
+		{"tailscaled-unreachable", sshStatusError(&net.OpError{Op: "dial", Err: syscall.ENOENT}), 5},
+		{"no-ssh-binary", checkNativeSSHFlags(lookErr), 6},
+		{"wrapped", fmt.Errorf("jump host: %w", sshPeerNotFoundError(st, "example.com", true)), 3},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("%s: ExitCode(%v) = %d; want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPeerHostNames(t *testing.T) {
+	ps := &ipnstate.PeerStatus{
+		DNSName:      "web.prod.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+		SSH_HostKeys: []string{testHostKey},
+	}
+	if got, want := peerHostNames(ps), []string{"web.prod.foo.ts.net", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peerHostNames = %q; want %q", got, want)
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): ps},
+	}
+	kh := knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true})
+	if want := "web.prod.foo.ts.net,web,100.64.0.3 " + testHostKey + "\n"; kh != want {
+		t.Errorf("known_hosts = %q; want %q", kh, want)
+	}
+	for _, arg := range []string{"web", "WEB", "web.prod.foo.ts.net", "web.prod.foo.ts.net."} {
+		if got, err := peerFromArg(st, arg); err != nil || got != ps {
+			t.Errorf("peerFromArg(%q) didn't find the peer", arg)
+		}
+	}
+	if got, _ := peerFromArg(st, "prod"); got != nil {
+		t.Error(`peerFromArg("prod") matched; want no match`)
+	}
+}
+
+func TestSSHLoginName(t *testing.T) {
+	old := userCurrent
+	defer func() { userCurrent = old }()
+	userCurrent = func() (*user.User, error) { return &user.User{Username: "local"}, nil }
+	oldMap := sshArgs.userMap
+	defer func() { sshArgs.userMap = oldMap }()
+	sshArgs.userMap = ""
+	dir := t.TempDir()
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", dir)
+	if err := os.WriteFile(filepath.Join(dir, "ssh_users.json"), []byte(`[{"Host": "router-*", "User": "root"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		destUser, loginFlag, host string
+		want                      string
+		wantErr                   bool
+	}{
+		{host: "web", want: "local"},
+		{destUser: "alice", host: "web", want: "alice"},
+		{loginFlag: "bob", host: "web", want: "bob"},
+		{destUser: "alice", loginFlag: "bob", host: "web", wantErr: true},
+		{host: "router-1", want: "root"},
+		{destUser: "alice", host: "router-1", want: "alice"},
+		{loginFlag: "bob", host: "router-1", want: "bob"},
+	}
+	for _, tt := range tests {
+		got, err := sshLoginName(tt.destUser, tt.loginFlag, tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("(%q, %q, %q): got %q, want error", tt.destUser, tt.loginFlag, tt.host, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("(%q, %q, %q) = %q, %v; want %q", tt.destUser, tt.loginFlag, tt.host, got, err, tt.want)
+		}
+	}
+
+	// A --user-map file that's missing is warned about and skipped.
+	oldStderr := Stderr
+	defer func() { Stderr = oldStderr }()
+	var stderr bytes.Buffer
+	Stderr = &stderr
+	sshArgs.userMap = filepath.Join(dir, "missing.json")
+	if got, err := sshLoginName("", "", "web"); err != nil || got != "local" {
+		t.Errorf("missing --user-map file: got %q, %v; want %q", got, err, "local")
+	}
+	if !strings.Contains(stderr.String(), "Warning: ignoring user map") {
+		t.Errorf("missing --user-map file: stderr = %q; want a warning", stderr.String())
+	}
+}
+
+func TestMatchSSHUserMap(t *testing.T) {
+	entries := []sshUserMapEntry{
+		{Host: "router-*", User: "root"},
+		{Host: "web.example.ts.net", User: "deploy"},
+		{Host: "web*", User: "www"},
+		{Host: "*", User: "fallback"},
+	}
+	tests := []struct {
+		host, want string
+	}{
+		{"router-1", "root"},
+		{"ROUTER-2", "root"},
+		{"web.example.ts.net.", "deploy"},
+		{"web", "www"},
+		{"db", "fallback"},
+	}
+	for _, tt := range tests {
+		got, err := matchSSHUserMap(entries, tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("matchSSHUserMap(%q) = %q, %v; want %q", tt.host, got, err, tt.want)
+		}
+	}
+	if got, err := matchSSHUserMap(entries[:2], "db"); err != nil || got != "" {
+		t.Errorf("no match: got %q, %v; want none", got, err)
+	}
+	if _, err := matchSSHUserMap([]sshUserMapEntry{{Host: "[", User: "x"}}, "db"); err == nil {
+		t.Error("bad pattern: got nil error")
+	}
+}
+
+func TestPeerFromArgShortNameTieBreak(t *testing.T) {
+	noSSH := &ipnstate.PeerStatus{DNSName: "web.bar.ts.net.", Online: true}
+	withSSH := &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKey}}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): noSSH,
+			testNodeKey(2): withSSH,
+		},
+	}
+	if got, err := peerFromArg(st, "web"); err != nil || got != withSSH {
+		t.Errorf(`peerFromArg("web") = %v, %v; want the SSH-enabled peer`, got, err)
+	}
+	if got, err := peerFromArg(st, "web.bar.ts.net"); err != nil || got != noSSH {
+		t.Errorf("full name: got %v, %v; want the exact match", got, err)
+	}
+
+	// With both SSH-enabled, the online one wins.
+	noSSH.SSH_HostKeys = []string{testHostKey2}
+	noSSH.Online = false
+	if got, err := peerFromArg(st, "web"); err != nil || got != withSSH {
+		t.Errorf(`peerFromArg("web") = %v, %v; want the online peer`, got, err)
+	}
+
+	// And with nothing to tell them apart, it's an error naming both.
+	noSSH.Online = true
+	_, err := peerFromArg(st, "web")
+	if err == nil {
+		t.Fatal("ambiguous name: got nil error")
+	}
+	for _, want := range []string{"web.foo.ts.net", "web.bar.ts.net"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestSSHBatchOptions(t *testing.T) {
+	old := sshArgs.batch
+	defer func() { sshArgs.batch = old }()
+
+	sshArgs.batch = false
+	if got := sshBatchOptions(); got != nil {
+		t.Errorf("without --batch, got %q; want none", got)
+	}
+	sshArgs.batch = true
+	got := strings.Join(sshBatchOptions(), " ")
+	for _, want := range []string{"-o BatchMode yes", "-o StrictHostKeyChecking yes"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("with --batch, got %q; want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestSSHMuxOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no ControlMaster on Windows")
+	}
+	oldDir, oldMux, oldNoMux := sshArgs.knownHostsDir, sshArgs.mux, sshArgs.noMux
+	defer func() { sshArgs.knownHostsDir, sshArgs.mux, sshArgs.noMux = oldDir, oldMux, oldNoMux }()
+
+	t.Setenv("TS_SSH_MUX", "true")
+	sshArgs.mux, sshArgs.noMux = false, true
+	if sshMuxEnabled() {
+		t.Error("--no-mux with TS_SSH_MUX set: mux enabled")
+	}
+	sshArgs.noMux = false
+	if !sshMuxEnabled() {
+		t.Error("TS_SSH_MUX set: mux not enabled")
+	}
+
+	dir := filepath.Join(t.TempDir(), "100% state")
+	sshArgs.knownHostsDir = dir
+	opts, err := sshMuxOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		t.Errorf("mux dir mode = %v; want 0700", perm)
+	}
+	got := strings.Join(opts, " ")
+	wantPath := fmt.Sprintf("ControlPath %q", filepath.Join(strings.ReplaceAll(dir, "%", "%%"), "ssh-mux-%r@%h:%p"))
+	for _, want := range []string{"-o ControlMaster auto", "-o ControlPersist 60", wantPath} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q; want it to contain %q", got, want)
+		}
+	}
+	if !strings.Contains(got, "100%% state") {
+		t.Errorf("got %q; want the %% in the dir escaped", got)
+	}
+}
+
+func TestSSHPeerNotFoundErrorSelf(t *testing.T) {
+	st := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "me.foo.ts.net.",
+			TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.9")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "web.foo.ts.net."},
+		},
+	}
+	for _, host := range []string{strings.TrimSuffix(st.Self.DNSName, "."), st.Self.DNSName, "me", "ME", "100.64.0.9"} {
+		err := sshPeerNotFoundError(st, host, false)
+		if err == nil || !strings.Contains(err.Error(), "--self") {
+			t.Errorf("host %q: got %v; want an error suggesting --self", host, err)
+		}
+	}
+	if err := sshPeerNotFoundError(st, "example.com", false); err != nil {
+		t.Errorf("non-tailnet host: got %v; want nil", err)
+	}
+}
+
+func TestKnownHostsForStatusOptions(t *testing.T) {
+	online := &ipnstate.PeerStatus{
+		DNSName:      "on.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		Online:       true,
+		SSH_HostKeys: []string{testHostKeyOn},
+	}
+	offline := &ipnstate.PeerStatus{
+		DNSName:      "off.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+		SSH_HostKeys: []string{testHostKeyOff},
+	}
+	st := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "me.foo.ts.net.",
+			TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.9")},
+			Online:       true,
+			SSH_HostKeys: []string{testHostKeyMe},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): online,
+			testNodeKey(2): offline,
+		},
+	}
+	tests := []struct {
+		name      string
+		opts      KnownHostsOptions
+		want      []string
+		wantLines int
+	}{
+		{
+			name: "default",
+			want: []string{"on.foo.ts.net,on,100.64.0.1 " + testHostKeyOn + "\n"},
+		},
+		{
+			name: "include_offline",
+			opts: KnownHostsOptions{IncludeOffline: true},
+			want: []string{
+				"on.foo.ts.net,on,100.64.0.1 " + testHostKeyOn + "\n",
+				"off.foo.ts.net,off,100.64.0.2 " + testHostKeyOff + "\n",
+			},
+		},
+		{
+			name: "offline_target",
+			opts: KnownHostsOptions{Targets: []*ipnstate.PeerStatus{offline, nil}},
+			want: []string{
+				"on.foo.ts.net,on,100.64.0.1 " + testHostKeyOn + "\n",
+				"off.foo.ts.net,off,100.64.0.2 " + testHostKeyOff + "\n",
+			},
+		},
+		{
+			name: "self_target",
+			opts: KnownHostsOptions{Targets: []*ipnstate.PeerStatus{st.Self}},
+			want: []string{
+				"me.foo.ts.net,me,100.64.0.9 " + testHostKeyMe + "\n",
+				"on.foo.ts.net,on,100.64.0.1 " + testHostKeyOn + "\n",
+			},
+		},
+		{
+			name: "omit_ips",
+			opts: KnownHostsOptions{IncludeOffline: true, OmitIPs: true},
+			want: []string{
+				"on.foo.ts.net,on " + testHostKeyOn + "\n",
+				"off.foo.ts.net,off " + testHostKeyOff + "\n",
+			},
+		},
+		{
+			name: "omit_short_names",
+			opts: KnownHostsOptions{IncludeOffline: true, OmitShortNames: true},
+			want: []string{
+				"on.foo.ts.net,100.64.0.1 " + testHostKeyOn + "\n",
+				"off.foo.ts.net,100.64.0.2 " + testHostKeyOff + "\n",
+			},
+		},
+		{
+			name:      "hash",
+			opts:      KnownHostsOptions{Hash: true},
+			wantLines: 3,
+		},
+		{
+			name:      "hash_omit_short_names",
+			opts:      KnownHostsOptions{Hash: true, OmitShortNames: true},
+			wantLines: 2,
+		},
+		{
+			name:      "hash_omit_ips",
+			opts:      KnownHostsOptions{Hash: true, OmitIPs: true},
+			wantLines: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := knownHostsString(t, st, tt.opts)
+			if !tt.opts.Hash {
+				if want := strings.Join(tt.want, ""); got != want {
+					t.Errorf("got:\n%s\nwant:\n%s", got, want)
+				}
+				return
+			}
+			lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+			if len(lines) != tt.wantLines {
+				t.Fatalf("got %d lines; want %d:\n%s", len(lines), tt.wantLines, got)
+			}
+			for _, line := range lines {
+				if !strings.HasPrefix(line, "|1|") || !strings.HasSuffix(line, " "+testHostKeyOn) {
+					t.Errorf("line %q isn't a hashed entry for the online peer", line)
+				}
+			}
+		})
+	}
+}
+
+func TestSSHAcceptNewOptions(t *testing.T) {
+	old := sshArgs.acceptNewHostKeys
+	defer func() { sshArgs.acceptNewHostKeys = old }()
+
+	sshArgs.acceptNewHostKeys = false
+	if got := sshAcceptNewOptions(); got != nil {
+		t.Errorf("without --accept-new-hostkeys, got %q; want none", got)
+	}
+	sshArgs.acceptNewHostKeys = true
+	want := []string{"-o", "StrictHostKeyChecking accept-new"}
+	if got := sshAcceptNewOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("with --accept-new-hostkeys, got %q; want %q", got, want)
+	}
+}
+
+func TestSSHConfigFileOptions(t *testing.T) {
+	old := sshArgs.noSSHConfig
+	defer func() { sshArgs.noSSHConfig = old }()
+
+	sshArgs.noSSHConfig = false
+	if got := sshConfigFileOptions(); got != nil {
+		t.Errorf("without --no-ssh-config, got %q; want none", got)
+	}
+	if got := sshJumpProxyCommand("ssh", "jump", "", ""); strings.Contains(got, "-F") {
+		t.Errorf("without --no-ssh-config, jump ProxyCommand %q has -F", got)
+	}
+	sshArgs.noSSHConfig = true
+	want := []string{"-F", "none"}
+	if got := sshConfigFileOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("with --no-ssh-config, got %q; want %q", got, want)
+	}
+	if got := sshJumpProxyCommand("ssh", "jump", "", ""); !strings.HasPrefix(got, "ssh -F none ") {
+		t.Errorf("with --no-ssh-config, jump ProxyCommand = %q; want it to pass -F none", got)
+	}
+}
+
+// TestSSHRemoteCommandTokens checks that remote command tokens reach
+// ssh unmodified when it's run as a child process, as on Windows,
+// using this test binary as a stand-in for ssh.
+func TestSSHRemoteCommandTokens(t *testing.T) {
+	if os.Getenv("TS_TEST_FAKE_SSH") == "1" {
+		for _, a := range argsAfterDashDash(os.Args) {
+			fmt.Printf("%q\n", a)
+		}
+		os.Exit(0)
+	}
+	if runtime.GOOS == "js" {
+		t.Skip("no subprocesses")
+	}
+	tokens := []string{"echo hello world", `a "quoted" arg`, `back\slash\`, "", "tab\there", "$HOME", "*"}
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestSSHRemoteCommandTokens$", "--"}, tokens...)...)
+	cmd.Env = append(os.Environ(), "TS_TEST_FAKE_SSH=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, tok := range tokens {
+		fmt.Fprintf(&want, "%q\n", tok)
+	}
+	if got := string(out); got != want.String() {
+		t.Errorf("fake ssh got tokens:\n%s\nwant:\n%s", got, want.String())
+	}
+
+	for _, args := range [][]string{{"echo hello world"}, {"echo", "hello", "world"}} {
+		if got := sshRemoteCommand(args); got != "echo hello world" {
+			t.Errorf("sshRemoteCommand(%q) = %q; want %q", args, got, "echo hello world")
+		}
+	}
+}
+
+func argsAfterDashDash(args []string) []string {
+	for i, a := range args {
+		if a == "--" {
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+func TestSSHTimings(t *testing.T) {
+	var timings sshTimings
+	start := time.Now()
+	for _, label := range []string{"status fetch", "known_hosts write", "exec handoff"} {
+		timings.add(label, start)
+	}
+	var buf bytes.Buffer
+	timings.print(&buf)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines; want 3:\n%s", len(lines), buf.String())
+	}
+	for i, label := range []string{"status fetch", "known_hosts write", "exec handoff"} {
+		if !strings.HasPrefix(lines[i], "timing: "+label+" ") {
+			t.Errorf("line %d = %q; want the %q phase", i, lines[i], label)
+		}
+	}
+}
+
+func TestReadSSHDestination(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+		rest    string
+	}{
+		{in: "web\n", want: "web"},
+		{in: "  alice@web.foo.ts.net \r\nmore input\n", want: "alice@web.foo.ts.net", rest: "more input\n"},
+		{in: "web", want: "web"},
+		{in: "", wantErr: true},
+		{in: " \n", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := bytes.NewReader([]byte(tt.in))
+		got, err := readSSHDestination(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.in, got, tt.want)
+		}
+		if rest := tt.in[len(tt.in)-r.Len():]; !tt.wantErr && rest != tt.rest {
+			t.Errorf("%q: left %q unread; want %q", tt.in, rest, tt.rest)
+		}
+	}
+}
+
+func TestSSHIPFamily(t *testing.T) {
+	oldV4, oldV6 := sshArgs.ipv4, sshArgs.ipv6
+	defer func() { sshArgs.ipv4, sshArgs.ipv6 = oldV4, oldV6 }()
+
+	ps := &ipnstate.PeerStatus{
+		DNSName: "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{
+			netaddr.MustParseIP("100.64.0.1"),
+			netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+		},
+		Online:       true,
+		SSH_HostKeys: []string{testHostKey},
+	}
+	v4Only := &ipnstate.PeerStatus{
+		DNSName:      "old.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): ps},
+	}
+	tests := []struct {
+		name       string
+		ipv4, ipv6 bool
+		wantHost   string
+		wantFlag   string
+		wantKH     string
+	}{
+		// known_hosts lists both IPs either way, as the
+		// shared file mustn't depend on one run's choice.
+		{"both", false, false, "100.64.0.1", "", "web.foo.ts.net,web,100.64.0.1,fd7a:115c:a1e0::1 " + testHostKey + "\n"},
+		{"v4", true, false, "100.64.0.1", "-4", "web.foo.ts.net,web,100.64.0.1,fd7a:115c:a1e0::1 " + testHostKey + "\n"},
+		{"v6", false, true, "fd7a:115c:a1e0::1", "-6", "web.foo.ts.net,web,100.64.0.1,fd7a:115c:a1e0::1 " + testHostKey + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sshArgs.ipv4, sshArgs.ipv6 = tt.ipv4, tt.ipv6
+			host, err := sshHostForIPFamily(ps, "100.64.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.wantHost {
+				t.Errorf("host = %q; want %q", host, tt.wantHost)
+			}
+			var flag string
+			if f := sshIPFamily(); f != 0 {
+				flag = fmt.Sprintf("-%d", f)
+			}
+			if flag != tt.wantFlag {
+				t.Errorf("ssh flag = %q; want %q", flag, tt.wantFlag)
+			}
+			if got := knownHostsString(t, st, sshKnownHostsOptions()); got != tt.wantKH {
+				t.Errorf("known_hosts:\n%s\nwant:\n%s", got, tt.wantKH)
+			}
+		})
+	}
+
+	sshArgs.ipv4, sshArgs.ipv6 = false, true
+	if _, err := sshHostForIPFamily(v4Only, "100.64.0.2"); err == nil {
+		t.Error("-6 with an IPv4-only peer: got nil error")
+	}
+	if _, err := sshHostForIPFamily(nil, "192.168.0.1"); err == nil {
+		t.Error("-6 with a non-peer IPv4 address: got nil error")
+	}
+	if host, err := sshHostForIPFamily(nil, "example.com"); err != nil || host != "example.com" {
+		t.Errorf("-6 with a non-peer name: got %q, %v; want it unchanged", host, err)
+	}
+}
+
+func TestPrintSSHResolve(t *testing.T) {
+	st := &ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "me.foo.ts.net.",
+			TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.9")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName: "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{
+					netaddr.MustParseIP("100.64.0.1"),
+					netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+				},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey, testHostKeyRSA},
+			},
+		},
+	}
+	var buf bytes.Buffer
+	if err := printSSHResolve(&buf, st, "alice@web"); err != nil {
+		t.Fatal(err)
+	}
+	want := `DNSName:       web.foo.ts.net
+TailscaleIPs:  100.64.0.1, fd7a:115c:a1e0::1
+Online:        true
+SSH host keys: 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := printSSHResolve(&buf, st, "me"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "DNSName:       me.foo.ts.net\n") {
+		t.Errorf("self: got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	err := printSSHResolve(&buf, st, "nosuchpeer")
+	if !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("unknown host: got %v; want ErrPeerNotFound", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unknown host: printed %q", buf.String())
+	}
+}
+
+func TestSSHResolveFlagArgs(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	tests := []struct {
+		name    string
+		self    bool
+		args    []string
+		wantErr string
+	}{
+		{"self-no-host", true, nil, "--resolve and --self are mutually exclusive"},
+		{"self-and-host", true, []string{"web"}, "--resolve and --self are mutually exclusive"},
+		{"no-host", false, nil, "usage: ssh --resolve"},
+		{"two-hosts", false, []string{"web", "db"}, "usage: ssh --resolve"},
+	}
+	for _, tt := range tests {
+		sshArgs = oldArgs
+		sshArgs.resolve = true
+		sshArgs.self = tt.self
+		err := runSSH(context.Background(), tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got %v; want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSSHConfigKnownHosts(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+
+	web := &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKeyWeb}}
+	db := &ipnstate.PeerStatus{DNSName: "db.foo.ts.net.", SSH_HostKeys: []string{testHostKeyDB}} // offline
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): web, testNodeKey(2): db},
+	}
+	read := func(f string) string {
+		t.Helper()
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Before any ssh_config is generated, there's no file for it.
+	if _, err := writeKnownHosts(st, sshKnownHostsOptions(web)); err != nil {
+		t.Fatal(err)
+	}
+	confFile := filepath.Join(sshArgs.knownHostsDir, sshConfigKnownHostsName)
+	if _, err := os.Stat(confFile); !os.IsNotExist(err) {
+		t.Fatalf("ssh_config known_hosts exists before generating ssh_config: %v", err)
+	}
+
+	f, err := writeSSHConfigKnownHosts(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != confFile {
+		t.Errorf("file = %q; want %q", f, confFile)
+	}
+	if kh := read(confFile); !strings.Contains(kh, testHostKeyDB) {
+		t.Errorf("ssh_config known_hosts lacks the offline peer:\n%s", kh)
+	}
+
+	// A plain run, which lists only online peers and targets,
+	// leaves the offline peer in the ssh_config's file, and keeps
+	// its keys current.
+	sshArgs.omitShortNames = true
+	web.SSH_HostKeys = []string{testHostKeyNew}
+	if _, err := writeKnownHosts(st, sshKnownHostsOptions(web)); err != nil {
+		t.Fatal(err)
+	}
+	want := knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true, Comments: true})
+	if kh := read(confFile); kh != want {
+		t.Errorf("after a plain run, ssh_config known_hosts =\n%s\nwant\n%s", kh, want)
+	}
+}
+
+func TestGenSSHConfig(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				SSH_HostKeys: []string{testHostKey},
+			},
+			testNodeKey(2): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				SSH_HostKeys: []string{testHostKey2},
+			},
+			testNodeKey(3): {
+				DNSName:      "web.bar.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+				SSH_HostKeys: []string{testHostKey3},
+			},
+			testNodeKey(4): {
+				DNSName:      "nossh.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.4")},
+			},
+		},
+	}
+	opts := sshHostOptions("/kh", "tailscale nc %h %p")
+	want := `# Generated by "tailscale ssh --generate-config". It includes the
+# path to the tailscale binary, so regenerate it after upgrading
+# or moving tailscale.
+
+Host db.foo.ts.net db
+    HostName 100.64.0.2
+    UserKnownHostsFile "/kh"
+    UpdateHostKeys no
+    StrictHostKeyChecking yes
+    ProxyCommand tailscale nc %h %p
+
+Host web.bar.ts.net
+    HostName 100.64.0.3
+    UserKnownHostsFile "/kh"
+    UpdateHostKeys no
+    StrictHostKeyChecking yes
+    ProxyCommand tailscale nc %h %p
+
+Host web.foo.ts.net
+    HostName 100.64.0.1
+    UserKnownHostsFile "/kh"
+    UpdateHostKeys no
+    StrictHostKeyChecking yes
+    ProxyCommand tailscale nc %h %p
+`
+	for i := 0; i < 3; i++ { // stable across runs
+		if got := string(genSSHConfig(st, opts)); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func TestSSHProxyCommandEmpty(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("no ProxyCommand on macOS")
+	}
+	if _, err := sshProxyCommand("", "/tmp/tailscaled.sock"); err == nil || !strings.Contains(err.Error(), "--tailscale-bin") {
+		t.Errorf("empty binary path: got %v; want an error about --tailscale-bin", err)
+	}
+	if _, err := sshProxyCommand("/usr/bin/tailscale", ""); err == nil || !strings.Contains(err.Error(), "--socket") {
+		t.Errorf("empty socket: got %v; want an error about --socket", err)
+	}
+
+	// RunRemote validates before writing known_hosts or running ssh.
+	oldSocket, oldRoot := sshArgs.socket, rootArgs.socket
+	defer func() { sshArgs.socket, rootArgs.socket = oldSocket, oldRoot }()
+	sshArgs.socket, rootArgs.socket = "", ""
+	dir := t.TempDir()
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", dir)
+	t.Setenv("PATH", dir)
+	sshPath := filepath.Join(dir, "ssh")
+	if runtime.GOOS == "windows" {
+		sshPath += ".exe"
+	}
+	if err := os.WriteFile(sshPath, []byte("#!/bin/sh\nexit 99\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+		},
+	}
+	_, _, code, err := runRemote(context.Background(), st, "web", []string{"true"})
+	if err == nil || !strings.Contains(err.Error(), "--socket") {
+		t.Errorf("RunRemote with no socket: got exit code %d, err %v; want a socket error", code, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ssh_known_hosts")); err == nil {
+		t.Error("RunRemote with no socket wrote known_hosts before failing")
+	}
+}
+
+func TestSSHSubnetRouter(t *testing.T) {
+	routes := func(s ...string) *views.IPPrefixSlice {
+		var ps []netaddr.IPPrefix
+		for _, r := range s {
+			ps = append(ps, netaddr.MustParseIPPrefix(r))
+		}
+		v := views.IPPrefixSliceOf(ps)
+		return &v
+	}
+	router := &ipnstate.PeerStatus{
+		DNSName:       "router.foo.ts.net.",
+		TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		PrimaryRoutes: routes("192.168.1.0/24"),
+	}
+	exit := &ipnstate.PeerStatus{
+		DNSName:       "exit.foo.ts.net.",
+		TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+		PrimaryRoutes: routes("0.0.0.0/0", "::/0"),
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): router,
+			testNodeKey(2): exit,
+		},
+	}
+	tests := []struct {
+		host string
+		want *ipnstate.PeerStatus
+	}{
+		{"192.168.1.5", router},
+		{"192.168.2.5", nil}, // exit node not in use
+		{"router", nil},
+		{"100.64.0.1", nil},
+	}
+	for _, tt := range tests {
+		if got := sshSubnetRouter(st, tt.host); got != tt.want {
+			t.Errorf("sshSubnetRouter(%q) = %v; want %v", tt.host, got, tt.want)
+		}
+	}
+
+	exit.ExitNode = true
+	if got := sshSubnetRouter(st, "192.168.2.5"); got != exit {
+		t.Errorf("with exit node in use, got %v; want the exit node", got)
+	}
+	if got := sshSubnetRouter(st, "192.168.1.5"); got != router {
+		t.Errorf("with exit node in use, subnet route: got %v; want the subnet router", got)
+	}
+
+	// Overlapping routes: the longest prefix wins, whichever peer
+	// comes first.
+	wide := &ipnstate.PeerStatus{
+		DNSName:       "wide.foo.ts.net.",
+		TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+		PrimaryRoutes: routes("10.0.0.0/8", "192.168.0.0/16"),
+	}
+	narrow := &ipnstate.PeerStatus{
+		DNSName:       "narrow.foo.ts.net.",
+		TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.4")},
+		PrimaryRoutes: routes("10.1.0.0/16"),
+	}
+	for _, order := range [][2]*ipnstate.PeerStatus{{wide, narrow}, {narrow, wide}} {
+		st.Peer[testNodeKey(3)], st.Peer[testNodeKey(4)] = order[0], order[1]
+		for _, tt := range []struct {
+			host string
+			want *ipnstate.PeerStatus
+		}{
+			{"10.1.2.3", narrow},
+			{"10.2.3.4", wide},
+			{"192.168.1.5", router},
+			{"192.168.2.5", wide},
+			{"172.16.0.1", exit},
+		} {
+			if got := sshSubnetRouter(st, tt.host); got != tt.want {
+				t.Errorf("overlapping routes, %s first: sshSubnetRouter(%q) = %v; want %v", order[0].DNSName, tt.host, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSSHCheckSubnetRouted(t *testing.T) {
+	oldArgs, oldStdout := sshArgs, Stdout
+	defer func() { sshArgs, Stdout = oldArgs, oldStdout }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	sshArgs.socket = "/tmp/tailscaled.sock"
+	sshArgs.check = true
+
+	routes := views.IPPrefixSliceOf([]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")})
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:       "router.foo.ts.net.",
+				TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:        true,
+				PrimaryRoutes: &routes,
+			},
+		},
+	}
+	argv, target, err := buildSSHCommand(sshBuildOptions{Status: st, Username: "alice", Host: "192.168.1.5", SSH: "/usr/bin/ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.peer != nil || target.router == nil {
+		t.Fatalf("resolved to peer %v, router %v; want the router only", target.peer, target.router)
+	}
+	for _, argv := range [][]string{argv, nil} {
+		var buf bytes.Buffer
+		Stdout = &buf
+		printSSHCheck(target, argv)
+		for _, want := range []string{"host:          192.168.1.5 (not a peer)\n", "reached via:   subnet router router.foo.ts.net\n"} {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("--check printed:\n%s\nwant it to contain %q", buf.String(), want)
+			}
+		}
+	}
+}
+
+func TestSSHProxyCommandNCOverride(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("no ProxyCommand on macOS")
+	}
+	pc, err := sshProxyCommand("/usr/bin/tailscale", "/tmp/tailscaled.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(pc, " nc %h %p") {
+		t.Errorf("default ProxyCommand = %q; want the nc subcommand", pc)
+	}
+
+	t.Setenv("TS_SSH_PROXY_NC_CMD", "debug-nc")
+	pc, err = sshProxyCommand("/usr/bin/tailscale", "/tmp/tailscaled.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(pc, " debug-nc %h %p") {
+		t.Errorf("ProxyCommand = %q; want the debug-nc subcommand", pc)
+	}
+
+	for _, bad := range []string{"nc; rm -rf ~", "nc x", "$(id)", "n'c"} {
+		t.Setenv("TS_SSH_PROXY_NC_CMD", bad)
+		if pc, err := sshProxyCommand("/usr/bin/tailscale", "/tmp/tailscaled.sock"); err == nil {
+			t.Errorf("TS_SSH_PROXY_NC_CMD=%q: got ProxyCommand %q; want an error", bad, pc)
+		}
+	}
+}
+
+func TestKnownHostsForStatusCertAuthority(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:       "web.foo.ts.net.",
+				TailscaleIPs:  []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:        true,
+				SSH_HostKeys:  []string{testHostKeyWeb},
+				SSH_HostCAKey: testHostCAKey,
+			},
+			testNodeKey(2): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKeyDB},
+			},
+		},
+	}
+	got := knownHostsString(t, st, KnownHostsOptions{})
+	want := "@cert-authority web.foo.ts.net,web,100.64.0.1 " + testHostCAKey + "\n" +
+		"db.foo.ts.net,db,100.64.0.2 " + testHostKeyDB + "\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(knownHostsString(t, st, KnownHostsOptions{Hash: true}), "\n"), "\n") {
+		if strings.HasSuffix(line, testHostCAKey) && !strings.HasPrefix(line, "@cert-authority |1|") {
+			t.Errorf("hashed CA line %q; want @cert-authority and a hashed host", line)
+		}
+	}
+}
+
+func TestSSHQuiet(t *testing.T) {
+	oldQuiet := sshArgs.quiet
+	defer func() { sshArgs.quiet = oldQuiet }()
+	var stderr bytes.Buffer
+	oldStderr := Stderr
+	Stderr = &stderr
+	defer func() { Stderr = oldStderr }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey, ""},
+			},
+		},
+	}
+	sshArgs.quiet = false
+	_, skipped := KnownHostsForStatus(st, KnownHostsOptions{})
+	if len(skipped) != 1 || stderr.Len() != 0 {
+		t.Fatalf("KnownHostsForStatus: skipped %q, stderr %q; want 1 skipped and no output", skipped, stderr.String())
+	}
+	warnSkippedHostKeys(skipped)
+	if !strings.Contains(stderr.String(), "Warning: skipped 1 malformed host key") {
+		t.Errorf("not quiet: stderr = %q; want a warning", stderr.String())
+	}
+
+	stderr.Reset()
+	sshArgs.quiet = true
+	warnSkippedHostKeys(skipped)
+	sshWarnf("something")
+	if stderr.Len() != 0 {
+		t.Errorf("quiet: stderr = %q; want nothing", stderr.String())
+	}
+
+	if err := sshCmd.FlagSet.Parse([]string{"-q", "host"}); err != nil {
+		t.Fatal(err)
+	}
+	if !sshArgs.quiet {
+		t.Error("-q didn't set quiet")
+	}
+	if got, want := sshVerbosityFlags(), []string{"-q"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("quiet: ssh flags = %q; want %q", got, want)
+	}
+}
+
+func TestWithStatusRetry(t *testing.T) {
+	oldDelay := statusRetryDelay
+	defer func() { statusRetryDelay = oldDelay }()
+	statusRetryDelay = time.Millisecond
+
+	want := &ipnstate.Status{BackendState: "Running"}
+	// fakeStatus returns a Status func, standing in for the local
+	// client's, that fails with each of errs in turn and then
+	// succeeds.
+	fakeStatus := func(calls *int, errs ...error) func(context.Context) (*ipnstate.Status, error) {
+		return func(context.Context) (*ipnstate.Status, error) {
+			*calls++
+			if *calls <= len(errs) {
+				return nil, errs[*calls-1]
+			}
+			return want, nil
+		}
+	}
+	ctx := context.Background()
+
+	var calls int
+	st, err := withStatusRetry(ctx, fakeStatus(&calls, fmt.Errorf("Get: %w", io.EOF)))
+	if err != nil || st != want {
+		t.Errorf("transient EOF: got %v, %v; want the Status", st, err)
+	}
+	if calls != 2 {
+		t.Errorf("transient EOF: %d calls; want 2", calls)
+	}
+
+	calls = 0
+	_, err = withStatusRetry(ctx, fakeStatus(&calls, io.EOF, io.EOF))
+	if !errors.Is(err, io.EOF) || calls != 2 {
+		t.Errorf("repeated EOF: got %v after %d calls; want EOF after 2", err, calls)
+	}
+
+	calls = 0
+	refused := &net.OpError{Op: "dial", Net: "unix", Err: syscall.ECONNREFUSED}
+	if _, err := withStatusRetry(ctx, fakeStatus(&calls, refused)); err == nil || calls != 1 {
+		t.Errorf("not running: got %v after %d calls; want an error after 1", err, calls)
+	}
+}
+
+func TestSSHRemoteCommandArgs(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	tests := []struct {
+		args []string // after tailscale's flags are parsed
+		want []string
+	}{
+		{[]string{"web", "--", "ls", "-la"}, []string{"ls", "-la"}},
+		{[]string{"web", "ls", "-la"}, []string{"ls", "-la"}},
+		{[]string{"web", "--", "--", "x"}, []string{"--", "x"}},
+		{[]string{"web", "--"}, nil},
+		{[]string{"web"}, nil},
+	}
+	for _, tt := range tests {
+		if err := sshCmd.FlagSet.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		rest := sshCmd.FlagSet.Args()
+		if rest[0] != "web" {
+			t.Fatalf("%q: host = %q", tt.args, rest[0])
+		}
+		got := sshRemoteCommandArgs(rest[1:])
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: remote command = %q; want %q", tt.args, got, tt.want)
+		}
+	}
+	if err := sshCmd.FlagSet.Parse([]string{"-t", "--", "web", "ls", "-la"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sshCmd.FlagSet.Args(), []string{"web", "ls", "-la"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-- before host: args = %q; want %q", got, want)
+	}
+}
+
+func TestSSHHostKeyAlgosOptions(t *testing.T) {
+	if got, err := sshHostKeyAlgosOptions(""); err != nil || got != nil {
+		t.Errorf("empty: got %q, %v; want none", got, err)
+	}
+	got, err := sshHostKeyAlgosOptions("ssh-ed25519,ecdsa-sha2-nistp256,ssh-ed25519-cert-v01@openssh.com,sk-ssh-ed25519-cert-v01@openssh.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-o", "HostKeyAlgorithms ssh-ed25519,ecdsa-sha2-nistp256,ssh-ed25519-cert-v01@openssh.com,sk-ssh-ed25519-cert-v01@openssh.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	for _, bad := range []string{"ssh-ed448", "ssh-ed25519,", "ssh-ed25519 ssh-rsa", "bogus-cert-v01@openssh.com"} {
+		if got, err := sshHostKeyAlgosOptions(bad); err == nil {
+			t.Errorf("%q: got %q; want an error", bad, got)
+		}
+	}
+}
+
+func TestKnownHostsForStatusComments(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDKtP4Tn4ByvBVUwa2Yd2AyP1S9dgDaUxAbrQn2gW2zq"},
+			},
+			testNodeKey(2): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				Online:       true,
+			},
+		},
+	}
+	got := knownHostsString(t, st, KnownHostsOptions{Comments: true})
+	want := "# peer web.foo.ts.net\nweb.foo.ts.net,web,100.64.0.1 " + st.Peer[testNodeKey(1)].SSH_HostKeys[0] + "\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant (no comment for db, which has no keys):\n%s", got, want)
+	}
+	if hashed := knownHostsString(t, st, KnownHostsOptions{Comments: true, Hash: true}); strings.Contains(hashed, "#") {
+		t.Errorf("hashed file has comments:\n%s", hashed)
+	}
+
+	// ssh still verifies the peer's key with the comments present.
+	f := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(f, []byte(got), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cb, err := knownhosts.New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(st.Peer[testNodeKey(1)].SSH_HostKeys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("web.foo.ts.net:22", &net.TCPAddr{}, pub); err != nil {
+		t.Errorf("verifying host key: %v", err)
+	}
+
+	// An unchanged file isn't rewritten.
+	oldDir := sshArgs.knownHostsDir
+	defer func() { sshArgs.knownHostsDir = oldDir }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	khf, err := writeKnownHosts(st, KnownHostsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(khf, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeKnownHosts(st, KnownHostsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(khf); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(old) {
+		t.Errorf("unchanged known_hosts was rewritten")
+	}
+}
+
+func TestSSHBindAddressFlags(t *testing.T) {
+	if got, err := sshBindAddressFlags(""); err != nil || got != nil {
+		t.Errorf("unset: got %q, %v; want none", got, err)
+	}
+	for _, addr := range []string{"192.168.1.2", "fd7a:115c:a1e0::1"} {
+		got, err := sshBindAddressFlags(addr)
+		if want := []string{"-b", addr}; err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, %v; want %q", addr, got, err, want)
+		}
+	}
+	for _, bad := range []string{"eth0", "192.168.1.2:22", "[::1]"} {
+		if got, err := sshBindAddressFlags(bad); err == nil {
+			t.Errorf("%q: got %q; want an error", bad, got)
+		}
+	}
+}
+
+func TestSSHEscapeCharFlags(t *testing.T) {
+	if got, err := sshEscapeCharFlags(""); err != nil || got != nil {
+		t.Errorf("unset: got %q, %v; want none", got, err)
+	}
+	for _, c := range []string{"none", "^", "%", "^A", "^z"} {
+		got, err := sshEscapeCharFlags(c)
+		if want := []string{"-e", c}; err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, %v; want %q", c, got, err, want)
+		}
+	}
+	for _, bad := range []string{"~~", " ", "\t", "^1", "^^", "é", "None"} {
+		if got, err := sshEscapeCharFlags(bad); err == nil {
+			t.Errorf("%q: got %q; want an error", bad, got)
+		}
+	}
+}
+
+func TestSSHJSONEvents(t *testing.T) {
+	oldJSONEvents := sshArgs.jsonEvents
+	defer func() { sshArgs.jsonEvents = oldJSONEvents }()
+	var stderr bytes.Buffer
+	oldStderr := Stderr
+	Stderr = &stderr
+	defer func() { Stderr = oldStderr }()
+
+	peer := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		Online:       true,
+	}
+	emitPreExec := func() {
+		emitSSHEvent(sshEvent{Event: "resolved", Host: "web", Addr: "100.64.0.1", Peer: newSSHEventPeer(peer), Router: newSSHEventPeer(nil)})
+		emitSSHEvent(sshEvent{Event: "known_hosts_written", KnownHostsFile: "/state/ssh_known_hosts"})
+		emitSSHEvent(sshEvent{Event: "connecting", Addr: "100.64.0.1"})
+	}
+
+	sshArgs.jsonEvents = false
+	emitPreExec()
+	if stderr.Len() != 0 {
+		t.Fatalf("without --json-events: stderr = %q; want nothing", stderr.String())
+	}
+
+	sshArgs.jsonEvents = true
+	emitPreExec()
+	want := []map[string]any{
+		{
+			"event": "resolved",
+			"host":  "web",
+			"addr":  "100.64.0.1",
+			"peer": map[string]any{
+				"dnsName":      "web.foo.ts.net",
+				"tailscaleIPs": []any{"100.64.0.1"},
+				"online":       true,
+			},
+		},
+		{"event": "known_hosts_written", "knownHostsFile": "/state/ssh_known_hosts"},
+		{"event": "connecting", "addr": "100.64.0.1"},
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), stderr.String())
+	}
+	for i, line := range lines {
+		var got map[string]any
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v: %q", i, err, line)
+		}
+		ts, ok := got["time"].(string)
+		if !ok {
+			t.Errorf("line %d: no time: %q", i, line)
+		} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Errorf("line %d: bad time: %v", i, err)
+		}
+		delete(got, "time")
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("line %d = %v; want %v", i, got, want[i])
+		}
+	}
+}
+
+func TestSSHLoginNameEnvDefault(t *testing.T) {
+	old := userCurrent
+	defer func() { userCurrent = old }()
+	userCurrent = func() (*user.User, error) { return &user.User{Username: "local"}, nil }
+	oldMap := sshArgs.userMap
+	defer func() { sshArgs.userMap = oldMap }()
+	sshArgs.userMap = ""
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", t.TempDir())
+	t.Setenv("TS_SSH_DEFAULT_USER", "admin")
+
+	for _, tt := range []struct {
+		destUser, loginFlag string
+		want                string
+	}{
+		{want: "admin"},
+		{destUser: "alice", want: "alice"},
+		{loginFlag: "bob", want: "bob"},
+	} {
+		got, err := sshLoginName(tt.destUser, tt.loginFlag, "web")
+		if err != nil || got != tt.want {
+			t.Errorf("(%q, %q) = %q, %v; want %q", tt.destUser, tt.loginFlag, got, err, tt.want)
+		}
+	}
+
+	// It's used for hosts no user map entry matches, and in place of
+	// a user map that doesn't parse.
+	oldStderr := Stderr
+	defer func() { Stderr = oldStderr }()
+	var stderr bytes.Buffer
+	Stderr = &stderr
+	dir := t.TempDir()
+	sshArgs.userMap = filepath.Join(dir, "users.json")
+	for _, tt := range []struct {
+		userMap, host string
+		want          string
+		wantWarn      bool
+	}{
+		{`[{"Host": "router-*", "User": "root"}]`, "router-1", "root", false},
+		{`[{"Host": "router-*", "User": "root"}]`, "web", "admin", false},
+		{`[{"Host": "router-*",`, "router-1", "admin", true},
+	} {
+		if err := os.WriteFile(sshArgs.userMap, []byte(tt.userMap), 0600); err != nil {
+			t.Fatal(err)
+		}
+		stderr.Reset()
+		got, err := sshLoginName("", "", tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("user map %s, host %q = %q, %v; want %q", tt.userMap, tt.host, got, err, tt.want)
+		}
+		if warned := strings.Contains(stderr.String(), "Warning:"); warned != tt.wantWarn {
+			t.Errorf("user map %s: stderr = %q; want warning: %v", tt.userMap, stderr.String(), tt.wantWarn)
+		}
+	}
+	sshArgs.userMap = ""
+
+	// It's used even when the local user can't be determined.
+	userCurrent = func() (*user.User, error) { return nil, errors.New("no passwd entry") }
+	t.Setenv("USER", "")
+	t.Setenv("LOGNAME", "")
+	if got, err := sshDefaultUsername(); err != nil || got != "admin" {
+		t.Errorf("with no local user: got %q, %v; want %q", got, err, "admin")
+	}
+}
+
+func TestSSHCopyIDCommand(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" {
+		t.Skip("remote command is a POSIX shell script")
+	}
+	keyDir := t.TempDir()
+	key1 := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGUGuxiIRbHJD6fmSYwy4BYVvLz2S2xss0wDzCYTgr8W alice's laptop"
+	key2 := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMpCbTQMe5RqrmkXWNkkTEJNmomrHytKLegqxchJSxtQ"
+	for name, k := range map[string]string{"id1.pub": key1, "id2.pub": key2} {
+		if err := os.WriteFile(filepath.Join(keyDir, name), []byte(k+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sshCopyIDCommand([]string{filepath.Join(keyDir, "missing")}); err == nil {
+		t.Error("missing key: got nil error")
+	}
+	cmd, err := sshCopyIDCommand([]string{filepath.Join(keyDir, "id1"), filepath.Join(keyDir, "id2.pub")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the command as the remote user's shell would, with a fake
+	// home directory. The second time, authorized_keys already has
+	// key2 with a different comment (and no final newline), after a
+	// different key it's a prefix of.
+	home := t.TempDir()
+	sshDir := filepath.Join(home, ".ssh")
+	authorizedKeys := filepath.Join(sshDir, "authorized_keys")
+	runRemote := func() string {
+		t.Helper()
+		c := exec.Command("sh", "-c", cmd)
+		c.Env = append(os.Environ(), "HOME="+home)
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return string(out)
+	}
+	out := runRemote()
+	if want := "installed: " + key1 + "\ninstalled: " + key2 + "\n"; out != want {
+		t.Errorf("first run output:\n%s\nwant:\n%s", out, want)
+	}
+	for f, want := range map[string]os.FileMode{sshDir: 0700, authorizedKeys: 0600} {
+		if fi, err := os.Stat(f); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != want {
+			t.Errorf("%s mode = %v; want %v", f, fi.Mode().Perm(), want)
+		}
+	}
+
+	if err := os.WriteFile(authorizedKeys, []byte(strings.TrimSuffix(key2, "Q")+"R other\n"+key2+" old comment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out = runRemote()
+	if !strings.Contains(out, "installed: "+key1) || !strings.Contains(out, "already installed: "+key2) {
+		t.Errorf("second run output:\n%s\nwant key1 installed and key2 already installed", out)
+	}
+	got, err := os.ReadFile(authorizedKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.TrimSuffix(key2, "Q") + "R other\n" + key2 + " old comment\n" + key1 + "\n"
+	if string(got) != want {
+		t.Errorf("authorized_keys =\n%s\nwant\n%s", got, want)
+	}
+	if out := runRemote(); strings.Count(out, "already installed") != 2 {
+		t.Errorf("third run output:\n%s\nwant both keys already installed", out)
+	}
+}
+
+func TestSSHPeerPatterns(t *testing.T) {
+	peer := func(name string, sshKeys ...string) *ipnstate.PeerStatus {
+		return &ipnstate.PeerStatus{DNSName: name + ".foo.ts.net.", SSH_HostKeys: sshKeys}
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): peer("web-2", testHostKey),
+			testNodeKey(2): peer("db-1", testHostKey2),
+			testNodeKey(3): peer("Web-1", testHostKey3),
+			testNodeKey(4): peer("web-3"), // no Tailscale SSH
+			testNodeKey(5): peer("webserver", testHostKey4),
+		},
+	}
+	names := func(peers []sshListPeer) []string {
+		var ret []string
+		for _, p := range peers {
+			ret = append(ret, p.DNSName)
+		}
+		return ret
+	}
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"web-*", []string{"Web-1.foo.ts.net", "web-2.foo.ts.net"}},
+		{"web-?.foo.ts.net", []string{"Web-1.foo.ts.net", "web-2.foo.ts.net"}},
+		{"*.foo.ts.net", []string{"Web-1.foo.ts.net", "db-1.foo.ts.net", "web-2.foo.ts.net", "webserver.foo.ts.net"}},
+		{"web", nil},
+		{"", []string{"Web-1.foo.ts.net", "db-1.foo.ts.net", "web-2.foo.ts.net", "webserver.foo.ts.net"}},
+	}
+	for _, tt := range tests {
+		got, err := sshListPeers(st, tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names(got), tt.want) {
+			t.Errorf("--list %q = %q; want %q", tt.pattern, names(got), tt.want)
+		}
+	}
+	if _, err := sshListPeers(st, "web-["); err == nil {
+		t.Error("bad pattern: got nil error")
+	}
+
+	// --resolve also includes peers without Tailscale SSH.
+	var buf bytes.Buffer
+	if err := printSSHResolve(&buf, st, "alice@web-*"); err != nil {
+		t.Fatal(err)
+	}
+	var gotNames []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "DNSName:") {
+			gotNames = append(gotNames, strings.TrimSpace(strings.TrimPrefix(line, "DNSName:")))
+		}
+	}
+	if want := []string{"Web-1.foo.ts.net", "web-2.foo.ts.net", "web-3.foo.ts.net"}; !reflect.DeepEqual(gotNames, want) {
+		t.Errorf("--resolve web-* printed:\n%s\nwant peers %q", buf.String(), want)
+	}
+	if err := printSSHResolve(&buf, st, "mail-*"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("no matches: got %v; want ErrPeerNotFound", err)
+	}
+
+	// A bracketed IPv6 address isn't a pattern.
+	st.Peer[testNodeKey(1)].TailscaleIPs = []netaddr.IP{netaddr.MustParseIP("fd7a:115c:a1e0::1")}
+	if isPeerPattern("[fd7a:115c:a1e0::1]") {
+		t.Error("isPeerPattern([fd7a:115c:a1e0::1]) = true; want false")
+	}
+	for _, arg := range []string{"[fd7a:115c:a1e0::1]", "alice@[fd7a:115c:a1e0::1]"} {
+		buf.Reset()
+		if err := printSSHResolve(&buf, st, arg); err != nil {
+			t.Errorf("--resolve %s: %v", arg, err)
+		} else if !strings.HasPrefix(buf.String(), "DNSName:       web-2.foo.ts.net\n") {
+			t.Errorf("--resolve %s printed:\n%s\nwant web-2", arg, buf.String())
+		}
+	}
+}
+
+// firstSSHOption returns the value ssh uses for the option key in args:
+// that of its first -o.
+func firstSSHOption(args []string, key string) (string, bool) {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-o" {
+			continue
+		}
+		k, v, _ := strings.Cut(args[i+1], " ")
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func TestSSHHostOptionsWithUser(t *testing.T) {
+	oldAccept := sshArgs.acceptNewHostKeys
+	defer func() { sshArgs.acceptNewHostKeys = oldAccept }()
+	sshArgs.acceptNewHostKeys = true
+
+	got := sshHostOptionsWithUser(nil, "/state/ssh_known_hosts", "")
+	if v, _ := firstSSHOption(got, "UserKnownHostsFile"); v != sshQuotePath("/state/ssh_known_hosts") {
+		t.Errorf("default UserKnownHostsFile = %s; want ours", v)
+	}
+
+	userOptions, err := sshUserOptions([]string{"UserKnownHostsFile=/home/alice/.ssh/known_hosts", "StrictHostKeyChecking=no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = sshHostOptionsWithUser(userOptions, "/state/ssh_known_hosts", "")
+	for key, want := range map[string]string{
+		"UserKnownHostsFile":    "/home/alice/.ssh/known_hosts",
+		"StrictHostKeyChecking": "no",
+		"UpdateHostKeys":        "no",
+	} {
+		if v, ok := firstSSHOption(got, key); !ok || v != want {
+			t.Errorf("%s = %q, %v; want %q", key, v, ok, want)
+		}
+	}
+}
+
+func TestSSHKeepaliveOptions(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	relayed := &ipnstate.PeerStatus{Relay: "nyc"}
+	direct := &ipnstate.PeerStatus{Relay: "nyc", CurAddr: "192.168.1.2:41641"}
+	on := []string{"-o", "ServerAliveInterval 15", "-o", "ServerAliveCountMax 3"}
+	off := []string{"-o", "ServerAliveInterval 0"}
+	tests := []struct {
+		name        string
+		ps          *ipnstate.PeerStatus
+		keepalive   bool
+		noKeepalive bool
+		options     []string
+		want        []string
+	}{
+		{name: "relayed", ps: relayed, want: on},
+		{name: "direct", ps: direct, want: nil},
+		{name: "non-peer", ps: nil, want: nil},
+		{name: "relayed-no-keepalive", ps: relayed, noKeepalive: true, want: off},
+		{name: "direct-keepalive", ps: direct, keepalive: true, want: on},
+		{name: "relayed-user-option", ps: relayed, options: []string{"ServerAliveInterval=60"}, want: nil},
+	}
+	for _, tt := range tests {
+		sshArgs.keepalive, sshArgs.noKeepalive, sshArgs.options = tt.keepalive, tt.noKeepalive, tt.options
+		if got := sshKeepaliveOptions(tt.ps); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// hasArgs reports whether args contains want as a contiguous run.
+func hasArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		if reflect.DeepEqual(args[i:i+len(want)], want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildSSHArgs(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	stateDir := filepath.Join(t.TempDir(), "state")
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", stateDir)
+	t.Setenv("TS_SSH_MUX", "")
+	knownHosts := sshQuotePath(filepath.Join(stateDir, "ssh_known_hosts"))
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				CurAddr:      "192.168.1.2:41641",
+				SSH_HostKeys: []string{testHostKey},
+			},
+			testNodeKey(2): {
+				DNSName:      "far.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				Online:       true,
+				Relay:        "nyc",
+				SSH_HostKeys: []string{testHostKey2},
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		host    string
+		command []string
+		flags   func()
+		check   func(t *testing.T, argv []string)
+	}{
+		{
+			name: "default",
+			host: "web",
+			check: func(t *testing.T, argv []string) {
+				if argv[0] != "/usr/bin/ssh" {
+					t.Errorf("argv[0] = %q; want the given ssh", argv[0])
+				}
+				if got := argv[len(argv)-1]; got != "alice@100.64.0.1" {
+					t.Errorf("last arg = %q; want alice@100.64.0.1", got)
+				}
+				if v, _ := firstSSHOption(argv, "UserKnownHostsFile"); v != knownHosts {
+					t.Errorf("UserKnownHostsFile = %s; want %s", v, knownHosts)
+				}
+				if v, _ := firstSSHOption(argv, "StrictHostKeyChecking"); v != "yes" {
+					t.Errorf("StrictHostKeyChecking = %q; want yes", v)
+				}
+				if runtime.GOOS != "darwin" {
+					if v, _ := firstSSHOption(argv, "ProxyCommand"); !strings.Contains(v, "--socket=") {
+						t.Errorf("ProxyCommand = %q; want one via tailscaled", v)
+					}
+				}
+				for _, key := range []string{"Compression", "ServerAliveInterval", "ForwardAgent"} {
+					if v, ok := firstSSHOption(argv, key); ok {
+						t.Errorf("%s = %q; want it unset", key, v)
+					}
+				}
+			},
+		},
+		{
+			name:    "remote-command",
+			host:    "web.foo.ts.net",
+			command: []string{"ls", "-l"},
+			check: func(t *testing.T, argv []string) {
+				if got, want := argv[len(argv)-4:], []string{"alice@100.64.0.1", "--", "ls", "-l"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("argv ends %q; want %q", got, want)
+				}
+			},
+		},
+		{
+			name: "port-agent-no-tty",
+			host: "web",
+			flags: func() {
+				sshArgs.port = 2222
+				sshArgs.forwardAgent = true
+				sshArgs.noTTY = true
+			},
+			check: func(t *testing.T, argv []string) {
+				for _, want := range [][]string{{"-p", "2222"}, {"-o", "ForwardAgent yes"}, {"-o", "RequestTTY no"}} {
+					if !hasArgs(argv, want...) {
+						t.Errorf("argv %q lacks %q", argv, want)
+					}
+				}
+			},
+		},
+		{
+			// Anything after user@host is the remote command, so
+			// ssh would run "-o ForwardAgent yes" on the peer.
+			name:    "forward-agent-before-host",
+			host:    "web",
+			command: []string{"ssh-add", "-l"},
+			flags:   func() { sshArgs.forwardAgent = true },
+			check: func(t *testing.T, argv []string) {
+				agent, host := -1, -1
+				for i, a := range argv {
+					if a == "ForwardAgent yes" && i > 0 && argv[i-1] == "-o" {
+						agent = i
+					}
+					if a == "alice@100.64.0.1" {
+						host = i
+					}
+				}
+				if agent == -1 || host == -1 || agent > host {
+					t.Errorf("argv %q: want -o ForwardAgent yes before alice@100.64.0.1", argv)
+				}
+			},
+		},
+		{
+			name:  "no-resolve",
+			host:  "web",
+			flags: func() { sshArgs.noResolve = true },
+			check: func(t *testing.T, argv []string) {
+				if got := argv[len(argv)-1]; got != "alice@web" {
+					t.Errorf("last arg = %q; want alice@web, unresolved", got)
+				}
+				if v, _ := firstSSHOption(argv, "UserKnownHostsFile"); v != knownHosts {
+					t.Errorf("UserKnownHostsFile = %s; want %s", v, knownHosts)
+				}
+				if runtime.GOOS != "darwin" {
+					if v, _ := firstSSHOption(argv, "ProxyCommand"); !strings.Contains(v, "--socket=") {
+						t.Errorf("ProxyCommand = %q; want one via tailscaled", v)
+					}
+				}
+			},
+		},
+		{
+			name:  "escape-char-none",
+			host:  "web",
+			flags: func() { sshArgs.escapeChar = "none" },
+			check: func(t *testing.T, argv []string) {
+				if !hasArgs(argv, "-e", "none") {
+					t.Errorf("argv %q lacks -e none", argv)
+				}
+			},
+		},
+		{
+			name:  "escape-char-caret",
+			host:  "web",
+			flags: func() { sshArgs.escapeChar = "^" },
+			check: func(t *testing.T, argv []string) {
+				if !hasArgs(argv, "-e", "^") {
+					t.Errorf("argv %q lacks -e ^", argv)
+				}
+			},
+		},
+		{
+			name:  "no-known-hosts",
+			host:  "web",
+			flags: func() { sshArgs.noKnownHosts = true },
+			check: func(t *testing.T, argv []string) {
+				if v, ok := firstSSHOption(argv, "UserKnownHostsFile"); ok {
+					t.Errorf("UserKnownHostsFile = %s; want ssh's default", v)
+				}
+			},
+		},
+		{
+			name: "relayed",
+			host: "far",
+			check: func(t *testing.T, argv []string) {
+				for key, want := range map[string]string{"Compression": "yes", "ServerAliveInterval": "15"} {
+					if v, _ := firstSSHOption(argv, key); v != want {
+						t.Errorf("%s = %q; want %q", key, v, want)
+					}
+				}
+			},
+		},
+		{
+			name:    "wrap",
+			host:    "web",
+			command: []string{"echo", "a; b"},
+			flags:   func() { sshArgs.wrap = "sudo -i" },
+			check: func(t *testing.T, argv []string) {
+				if got, want := argv[len(argv)-3:], []string{"--", "sudo -i", "echo 'a; b'"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("argv ends %q; want %q", got, want)
+				}
+				if v, ok := firstSSHOption(argv, "RequestTTY"); ok {
+					t.Errorf("RequestTTY = %q; want ssh's default with a command", v)
+				}
+			},
+		},
+		{
+			name:  "wrap-interactive",
+			host:  "web",
+			flags: func() { sshArgs.wrap = "sudo -i" },
+			check: func(t *testing.T, argv []string) {
+				if got, want := argv[len(argv)-2:], []string{"--", "sudo -i"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("argv ends %q; want %q", got, want)
+				}
+				if v, _ := firstSSHOption(argv, "RequestTTY"); v != "yes" {
+					t.Errorf("RequestTTY = %q; want yes", v)
+				}
+			},
+		},
+		{
+			name: "user-options-ip-family-quiet",
+			host: "web",
+			flags: func() {
+				sshArgs.options = stringsFlag{"StrictHostKeyChecking=no", "ServerAliveInterval=60"}
+				sshArgs.ipv4 = true
+				sshArgs.quiet = true
+			},
+			check: func(t *testing.T, argv []string) {
+				for key, want := range map[string]string{"StrictHostKeyChecking": "no", "ServerAliveInterval": "60"} {
+					if v, _ := firstSSHOption(argv, key); v != want {
+						t.Errorf("%s = %q; want %q", key, v, want)
+					}
+				}
+				if !hasArgs(argv, "-q") || !hasArgs(argv, "-4") {
+					t.Errorf("argv %q lacks -q or -4", argv)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sshArgs = oldArgs
+			sshArgs.socket = "/tmp/tailscaled.sock"
+			if tt.flags != nil {
+				tt.flags()
+			}
+			argv, cleanup, err := buildSSHArgs(context.Background(), sshBuildOptions{
+				Status:        st,
+				Username:      "alice",
+				Host:          tt.host,
+				RemoteCommand: tt.command,
+				SSH:           "/usr/bin/ssh",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			tt.check(t, argv)
+		})
+	}
+
+	sshArgs = oldArgs
+	sshArgs.socket = "/tmp/tailscaled.sock"
+	if _, _, err := buildSSHArgs(context.Background(), sshBuildOptions{Status: st, Username: "alice", Host: "webx", SSH: "/usr/bin/ssh"}); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("typo of a peer name: got %v; want ErrPeerNotFound", err)
+	}
+	t.Setenv("PATH", t.TempDir())
+	if _, _, err := buildSSHArgs(context.Background(), sshBuildOptions{Status: st, Username: "alice", Host: "web"}); !errors.Is(err, ErrNoSSHBinary) {
+		t.Errorf("no ssh installed: got %v; want ErrNoSSHBinary", err)
+	}
+}
+
+func TestBuildSSHArgsBareTailscaleIP(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.socket = "/tmp/tailscaled.sock"
+	stateDir := filepath.Join(t.TempDir(), "state")
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", stateDir)
+
+	// Peers with no MagicDNS name, only Tailscale IPs.
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+			testNodeKey(2): {
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				Online:       true,
+			},
+		},
+	}
+	build := func(host string) ([]string, error) {
+		argv, _, err := buildSSHArgs(context.Background(), sshBuildOptions{Status: st, Username: "alice", Host: host, SSH: "/usr/bin/ssh"})
+		return argv, err
+	}
+
+	for _, host := range []string{"100.64.0.1", "fd7a:115c:a1e0::1", "[fd7a:115c:a1e0::1]"} {
+		argv, err := build(host)
+		if err != nil {
+			t.Errorf("%s: %v", host, err)
+			continue
+		}
+		if got := argv[len(argv)-1]; got != "alice@100.64.0.1" {
+			t.Errorf("%s: last arg = %q; want alice@100.64.0.1", host, got)
+		}
+	}
+	kh, err := os.ReadFile(filepath.Join(stateDir, "ssh_known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(kh), "100.64.0.1") || !strings.Contains(string(kh), testHostKey) {
+		t.Errorf("known_hosts lacks the IP-only peer's key:\n%s", kh)
+	}
+
+	_, err = build("100.64.0.2")
+	if !errors.Is(err, ErrSSHNotEnabled) {
+		t.Fatalf("peer without SSH host keys: got %v; want ErrSSHNotEnabled", err)
+	}
+	if !strings.HasPrefix(err.Error(), "100.64.0.2 has no SSH host keys") {
+		t.Errorf("error %q doesn't name the peer by its IP", err)
+	}
+}
+
+func TestSSHJumpTimeout(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	t.Setenv("TS_SSH_KNOWN_HOSTS_DIR", filepath.Join(t.TempDir(), "state"))
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey},
+			},
+			testNodeKey(2): {
+				DNSName:      "bastion.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKey2},
+			},
+		},
+	}
+	build := func() []string {
+		t.Helper()
+		argv, _, err := buildSSHArgs(context.Background(), sshBuildOptions{Status: st, Username: "alice", Host: "web", SSH: "/usr/bin/ssh"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return argv
+	}
+	sshArgs.socket = "/tmp/tailscaled.sock"
+	sshArgs.jump = "bastion"
+	sshArgs.timeout = 30 * time.Second
+	sshArgs.jumpTimeout = 5 * time.Second
+	argv := build()
+	if v, _ := firstSSHOption(argv, "ConnectTimeout"); v != "30" {
+		t.Errorf("target ConnectTimeout = %q; want 30", v)
+	}
+	proxy, _ := firstSSHOption(argv, "ProxyCommand")
+	if !strings.Contains(proxy, "ConnectTimeout 5") || strings.Contains(proxy, "ConnectTimeout 30") {
+		t.Errorf("jump ProxyCommand = %q; want ConnectTimeout 5 only", proxy)
+	}
+
+	sshArgs.jumpTimeout = 0
+	if proxy, _ := firstSSHOption(build(), "ProxyCommand"); strings.Contains(proxy, "ConnectTimeout") {
+		t.Errorf("without --jump-timeout, jump ProxyCommand = %q; want no ConnectTimeout", proxy)
+	}
+}
+
+func TestSSHHistory(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	file, err := sshHistoryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < sshHistoryMax+5; i++ {
+		recordSSHHistory(fmt.Sprintf("host%d", i))
+	}
+	recordSSHHistory("host10") // already there; moves to the front
+	hist, err := readSSHHistory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != sshHistoryMax {
+		t.Fatalf("history has %d entries; want %d: %q", len(hist), sshHistoryMax, hist)
+	}
+	if got, want := hist[:3], []string{"host10", "host24", "host23"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history starts %q; want %q", got, want)
+	}
+	if got, want := hist[len(hist)-1], "host5"; got != want {
+		t.Errorf("oldest entry = %q; want %q", got, want)
+	}
+	for _, h := range hist[1:] {
+		if h == "host10" {
+			t.Error("host10 is in the history twice")
+		}
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("history file mode = %#o; want 0600", perm)
+		}
+	}
+
+	sshArgs.noHistory = true
+	recordSSHHistory("secret")
+	if hist, _ := readSSHHistory(file); hist[0] == "secret" {
+		t.Error("--no-history: host was recorded")
+	}
+}
+
+func TestKnownHostsMode(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+
+	for _, bad := range []string{"", "abc", "999", "01644", "0200", "0664", "0606"} {
+		var m fileModeFlag
+		if err := m.Set(bad); err == nil {
+			t.Errorf("--known-hosts-mode=%q: got no error", bad)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix file permissions on Windows")
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKey}},
+		},
+	}
+	// The second write has the same contents, but the new mode must
+	// still be applied.
+	for _, mode := range []string{"0600", "0640"} {
+		if err := sshArgs.knownHostsMode.Set(mode); err != nil {
+			t.Fatal(err)
+		}
+		f, err := writeKnownHosts(st, KnownHostsOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%#o", fi.Mode().Perm()); got != mode {
+			t.Errorf("--known-hosts-mode=%s: file mode = %s", mode, got)
+		}
+	}
+}
+
+func TestSSHHostWithoutPath(t *testing.T) {
+	tests := []struct {
+		host string
+		cmd  []string
+		want string
+	}{
+		{"web1", nil, "web1"},
+		{"web1/var/www", nil, "web1"},
+		{"[fd7a:115c:a1e0::1]/var/www", nil, "[fd7a:115c:a1e0::1]"},
+		{"web1/var/www", []string{"ls"}, "web1/var/www"},
+	}
+	for _, tt := range tests {
+		if got := sshHostWithoutPath(tt.host, tt.cmd); got != tt.want {
+			t.Errorf("sshHostWithoutPath(%q, %q) = %q; want %q", tt.host, tt.cmd, got, tt.want)
+		}
+	}
+	// The user is split off first, as by parseSSHDestination.
+	user, host, _, err := parseSSHDestination("deploy@web1/var/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "deploy" || sshHostWithoutPath(host, nil) != "web1" {
+		t.Errorf("deploy@web1/var/www: got user %q, host %q", user, sshHostWithoutPath(host, nil))
+	}
+}
+
+func TestSystemKnownHostsConflicts(t *testing.T) {
+	var stderr bytes.Buffer
+	oldStderr := Stderr
+	Stderr = &stderr
+	defer func() { Stderr = oldStderr }()
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+
+	ps := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		SSH_HostKeys: []string{testHostKey, testHostKeyRSA},
+	}
+	sysFile := filepath.Join(t.TempDir(), "ssh_known_hosts")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(sysFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# managed by config management\n" +
+		"web.foo.ts.net,other.example.com " + testHostKey2 + "\n" +
+		"100.64.0.1 " + testHostKeyECDSA + "\n" + // no ECDSA key from Tailscale to compare
+		hashKnownHostsName("web") + " " + testHostKey3 + "\n" +
+		"100.64.0.1 " + testHostKey + "\n" +
+		"garbage\n")
+	got := systemKnownHostsConflicts(sysFile, ps, 0)
+	if want := []string{"web.foo.ts.net", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %q; want %q", got, want)
+	}
+
+	warnSystemKnownHostsConflicts(sysFile, ps)
+	if want := sysFile + " lists web.foo.ts.net with a different host key"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("stderr = %q; want it to contain %q", stderr.String(), want)
+	}
+
+	// An entry for the right key alongside a stale one is fine.
+	write("web.foo.ts.net " + testHostKey2 + "\nweb.foo.ts.net " + testHostKey + "\n")
+	if got := systemKnownHostsConflicts(sysFile, ps, 0); len(got) != 0 {
+		t.Errorf("with a matching entry: conflicts = %q; want none", got)
+	}
+	// With a non-default port, only [host]:port entries count.
+	write("web.foo.ts.net " + testHostKey2 + "\n[web]:2222 " + testHostKey2 + "\n")
+	if got, want := systemKnownHostsConflicts(sysFile, ps, 2222), []string{"[web]:2222"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("port 2222: conflicts = %q; want %q", got, want)
+	}
+	if got := systemKnownHostsConflicts(filepath.Join(t.TempDir(), "missing"), ps, 0); got != nil {
+		t.Errorf("missing file: conflicts = %q; want none", got)
+	}
+}
+
+func TestSSHWrapCommand(t *testing.T) {
+	tests := []struct {
+		wrap string
+		cmd  []string
+		want []string
+	}{
+		{"", nil, nil},
+		{"", []string{"ls", "-l"}, []string{"ls", "-l"}},
+		{"sudo -i", nil, []string{"sudo -i"}},
+		{"sudo -i", []string{"cmd"}, []string{"sudo -i", "cmd"}},
+		{"sudo -i", []string{"ls", "-l", "my file"}, []string{"sudo -i", "ls -l 'my file'"}},
+		{"bash -lc", []string{"echo $HOME && id"}, []string{"bash -lc", "'echo $HOME && id'"}},
+	}
+	for _, tt := range tests {
+		got := sshWrapCommand(tt.wrap, tt.cmd)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sshWrapCommand(%q, %q) = %q; want %q", tt.wrap, tt.cmd, got, tt.want)
+		}
+		// What the remote shell runs, for the system ssh and the
+		// built-in client alike.
+		if tt.wrap == "sudo -i" && len(tt.cmd) == 1 && sshRemoteCommand(got) != "sudo -i cmd" {
+			t.Errorf("remote command = %q; want %q", sshRemoteCommand(got), "sudo -i cmd")
+		}
+	}
+}
+
+func TestResolvePeer(t *testing.T) {
+	web := &ipnstate.PeerStatus{
+		DNSName: "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{
+			netaddr.MustParseIP("100.64.0.1"),
+			netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+		},
+	}
+	db := &ipnstate.PeerStatus{
+		DNSName:      "db.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): web,
+			testNodeKey(2): db,
+		},
+	}
+	tests := []struct {
+		arg      string
+		wantPeer *ipnstate.PeerStatus
+		wantAddr string
+	}{
+		{"web.foo.ts.net", web, "100.64.0.1"},
+		{"web.foo.ts.net.", web, "100.64.0.1"},
+		{"DB.foo.ts.net", db, "100.64.0.2"},
+		{"web", web, "100.64.0.1"},
+		{"db", db, "100.64.0.2"},
+		{"100.64.0.2", db, "100.64.0.2"},
+		{"fd7a:115c:a1e0::1", web, "100.64.0.1"},
+		{"100.64.0.9", nil, "100.64.0.9"},
+		{"example.com", nil, "example.com"},
+	}
+	for _, tt := range tests {
+		peer, addr, err := resolvePeer(st, tt.arg)
+		if err != nil {
+			t.Errorf("resolvePeer(%q): %v", tt.arg, err)
+			continue
+		}
+		if peer != tt.wantPeer || addr != tt.wantAddr {
+			t.Errorf("resolvePeer(%q) = %v, %q; want %v, %q", tt.arg, peerName(peer), addr, peerName(tt.wantPeer), tt.wantAddr)
+		}
+	}
+}
+
+func peerName(ps *ipnstate.PeerStatus) string {
+	if ps == nil {
+		return "<nil>"
+	}
+	return ps.DNSName
+}
+
+func TestPrintSSHKnownHosts(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	var stdout bytes.Buffer
+	oldStdout := Stdout
+	Stdout = &stdout
+	defer func() { Stdout = oldStdout }()
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "on.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+				Online:       true,
+				SSH_HostKeys: []string{testHostKeyOn},
+			},
+			testNodeKey(2): {
+				DNSName:      "off.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+				SSH_HostKeys: []string{testHostKeyOff},
+			},
+		},
+	}
+	printSSHKnownHosts(st)
+	want := "# peer on.foo.ts.net\non.foo.ts.net,on,100.64.0.1 " + testHostKeyOn + "\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("printed:\n%s\nwant:\n%s", got, want)
+	}
+
+	stdout.Reset()
+	sshArgs.includeOffline = true
+	sshArgs.omitShortNames = true
+	printSSHKnownHosts(st)
+	want = knownHostsString(t, st, KnownHostsOptions{IncludeOffline: true, OmitShortNames: true, Comments: true})
+	if got := stdout.String(); got != want || !strings.Contains(got, "off.foo.ts.net") {
+		t.Errorf("with --include-offline --omit-short-names: printed:\n%s\nwant:\n%s", got, want)
+	}
+
+	stdout.Reset()
+	sshArgs.hashKnownHosts = true
+	printSSHKnownHosts(st)
+	if got := stdout.String(); strings.Contains(got, "foo.ts.net") || strings.Count(got, "|1|") != 4 {
+		t.Errorf("with --hash-known-hosts: printed:\n%s\nwant 4 hashed lines", got)
+	}
+}
+
+func TestSSHExpandEnv(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	t.Setenv("TS_HOST", "web.foo.ts.net")
+	t.Setenv("TS_USER", "deploy")
+	t.Setenv("TS_EMPTY", "")
+
+	sshArgs.expandEnv = false
+	for _, dest := range []string{"${TS_HOST}", "$TS_USER@$TS_HOST", "${TS_EMPTY}"} {
+		if got, err := sshExpandEnv(dest); err != nil || got != dest {
+			t.Errorf("without --expand-env: sshExpandEnv(%q) = %q, %v; want it unchanged", dest, got, err)
+		}
+	}
+
+	sshArgs.expandEnv = true
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"${TS_HOST}", "web.foo.ts.net"},
+		{"$TS_USER@${TS_HOST}", "deploy@web.foo.ts.net"},
+		{"ssh://${TS_USER}@${TS_HOST}:2222", "ssh://deploy@web.foo.ts.net:2222"},
+		{"web", "web"},
+	}
+	for _, tt := range tests {
+		if got, err := sshExpandEnv(tt.dest); err != nil || got != tt.want {
+			t.Errorf("sshExpandEnv(%q) = %q, %v; want %q", tt.dest, got, err, tt.want)
+		}
+	}
+	for _, dest := range []string{"${TS_EMPTY}", "$TS_UNSET_FOR_TEST"} {
+		if _, err := sshExpandEnv(dest); err == nil {
+			t.Errorf("sshExpandEnv(%q): got no error for an empty expansion", dest)
+		}
+	}
+}
+
+func TestWriteKnownHostsCorrupt(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	sshArgs.verbose = 1
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "web.foo.ts.net.", Online: true, SSH_HostKeys: []string{testHostKey}},
+		},
+	}
+	f, err := writeKnownHosts(st, KnownHostsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem := knownHostsFileProblem(f, want, 0644); problem != "" {
+		t.Errorf("freshly written file %s", problem)
+	}
+	if logBuf.Len() != 0 {
+		t.Errorf("notice logged for a missing file: %q", logBuf.String())
+	}
+
+	// As after a partial write of the key by something else.
+	corrupt := []byte("web.foo.ts.net,web " + testHostKey[:30] + "\x00\x00\n")
+	if err := os.WriteFile(f, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problem := knownHostsFileProblem(f, corrupt, 0644); problem != "is corrupt" {
+		t.Errorf("corrupt file: problem = %q; want %q", problem, "is corrupt")
+	}
+	if _, err := writeKnownHosts(st, KnownHostsOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(f); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("after regenerating: known_hosts = %q, %v; want %q", got, err, want)
+	}
+	if !strings.Contains(logBuf.String(), "is corrupt; regenerating it") {
+		t.Errorf("log = %q; want a notice about the corrupt file", logBuf.String())
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(f, 0666); err != nil {
+			t.Fatal(err)
+		}
+		logBuf.Reset()
+		if _, err := writeKnownHosts(st, KnownHostsOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != 0644 {
+			t.Errorf("after regenerating a mode 0666 file: stat = %v, %v; want mode 0644", fi.Mode(), err)
+		}
+		if !strings.Contains(logBuf.String(), "has mode 0666 rather than 0644") {
+			t.Errorf("log = %q; want a notice about the mode", logBuf.String())
+		}
+	}
+}
+
+func TestSSHCompletions(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {DNSName: "web.foo.ts.net."},
+			testNodeKey(2): {DNSName: "db.foo.ts.net."},
+			testNodeKey(3): {DNSName: "Router.foo.ts.net."},
+		},
+	}
+	tests := []struct {
+		partial string
+		want    []string
+	}{
+		{"", []string{"Router", "Router.foo.ts.net", "db", "db.foo.ts.net", "web", "web.foo.ts.net"}},
+		{"ro", []string{"Router", "Router.foo.ts.net"}},
+		{"root@w", []string{"root@web", "root@web.foo.ts.net"}},
+		{"web.", []string{"web.foo.ts.net"}},
+		{"x", nil},
+	}
+	for _, tt := range tests {
+		if got := sshCompletions(st, tt.partial); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("--complete %q = %q; want %q", tt.partial, got, tt.want)
+		}
+	}
+}
+
+func TestResolvePeerByNodeID(t *testing.T) {
+	web := &ipnstate.PeerStatus{
+		ID:           "nWeb1CNTRL",
+		PublicKey:    testNodeKey(1),
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+	}
+	db := &ipnstate.PeerStatus{
+		ID:           "nDb1CNTRL",
+		PublicKey:    testNodeKey(2),
+		DNSName:      "db.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): web, testNodeKey(2): db},
+	}
+	webKey, err := testNodeKey(1).MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		arg       string
+		wantPeer  *ipnstate.PeerStatus
+		wantHost  string
+		wantError bool
+	}{
+		{"nodeid:nWeb1CNTRL", web, "100.64.0.1", false},
+		{"nodeid:nDb1CNTRL", db, "100.64.0.2", false},
+		{string(webKey), web, "100.64.0.1", false},
+		{"nodeid:nGone1CNTRL", nil, "nodeid:nGone1CNTRL", false},
+		{"nodeid:", nil, "nodeid:", false},
+		{"nodekey:" + strings.Repeat("0", 64), nil, "nodekey:" + strings.Repeat("0", 64), false},
+		{"nodekey:zz", nil, "", true},
+	}
+	for _, tt := range tests {
+		ps, host, err := resolvePeer(st, tt.arg)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("resolvePeer(%q): got nil error", tt.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolvePeer(%q): %v", tt.arg, err)
+			continue
+		}
+		if ps != tt.wantPeer || host != tt.wantHost {
+			t.Errorf("resolvePeer(%q) = %v, %q; want %v, %q", tt.arg, peerName(ps), host, peerName(tt.wantPeer), tt.wantHost)
+		}
+	}
+}
+
+func TestKnownHostsPeerIPs(t *testing.T) {
+	st := &ipnstate.Status{
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.9")},
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "me.foo.ts.net.",
+			TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.9")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			testNodeKey(1): {
+				DNSName:      "web.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+				SSH_HostKeys: []string{testHostKeyWeb},
+			},
+			testNodeKey(2): {
+				DNSName:      "db.foo.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("10.1.2.3")}, // custom IP pool
+				SSH_HostKeys: []string{testHostKeyDB},
+			},
+		},
+	}
+	kh, _ := KnownHostsForStatus(st, KnownHostsOptions{IncludeOffline: true})
+	// keys is the host keys known_hosts lists for each host name or IP.
+	keys := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(kh)), "\n") {
+		hosts, key, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("bad known_hosts line %q", line)
+		}
+		for _, h := range strings.Split(hosts, ",") {
+			keys[h] = append(keys[h], key)
+		}
+	}
+	for host, want := range map[string]string{
+		"100.64.0.1":        testHostKeyWeb,
+		"fd7a:115c:a1e0::1": testHostKeyWeb,
+		"10.1.2.3":          testHostKeyDB,
+	} {
+		if got := keys[host]; !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("known_hosts keys for %s = %q; want %q", host, got, want)
+		}
+	}
+	if got, ok := keys["100.64.0.9"]; ok {
+		t.Errorf("known_hosts lists this node's IP, with keys %q", got)
+	}
+}
+
+func TestWriteKnownHostsKeepsListedPeers(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	for _, hash := range []bool{false, true} {
+		sshArgs = oldArgs
+		sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+		sshArgs.hashKnownHosts = hash
+
+		web := &ipnstate.PeerStatus{DNSName: "web.foo.ts.net.", SSH_HostKeys: []string{testHostKeyWeb}}
+		db := &ipnstate.PeerStatus{DNSName: "db.foo.ts.net.", SSH_HostKeys: []string{testHostKeyDB}}
+		ipOnly := &ipnstate.PeerStatus{TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")}, SSH_HostKeys: []string{testHostKey3}}
+		other := &ipnstate.PeerStatus{DNSName: "other.foo.ts.net.", SSH_HostKeys: []string{testHostKey4}}
+		st := &ipnstate.Status{
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				testNodeKey(1): web, testNodeKey(2): db, testNodeKey(3): ipOnly, testNodeKey(4): other,
+			},
+		}
+		// As if three runs connected to offline peers one after
+		// another, each while the earlier ones' ssh may still be
+		// reading the file.
+		var f string
+		for _, target := range []*ipnstate.PeerStatus{web, db, ipOnly} {
+			var err error
+			if f, err = writeKnownHosts(st, sshKnownHostsOptions(target)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := knownHostsPeers(st, mustReadFile(t, f))
+		if want := []*ipnstate.PeerStatus{web, db, ipOnly}; !sameKnownHostsPeers(got, want) {
+			t.Errorf("hash=%v: known_hosts lists %q; want %q", hash, knownHostsPeerNames(got), knownHostsPeerNames(want))
+		}
+
+		// A peer that leaves the tailnet is dropped; its keys
+		// shouldn't be trusted for whatever gets its IP later.
+		delete(st.Peer, testNodeKey(2))
+		if _, err := writeKnownHosts(st, sshKnownHostsOptions(web)); err != nil {
+			t.Fatal(err)
+		}
+		got = knownHostsPeers(st, mustReadFile(t, f))
+		if want := []*ipnstate.PeerStatus{web, ipOnly}; !sameKnownHostsPeers(got, want) {
+			t.Errorf("hash=%v: after db left, known_hosts lists %q; want %q", hash, knownHostsPeerNames(got), knownHostsPeerNames(want))
+		}
+		if kh := string(mustReadFile(t, f)); strings.Contains(kh, testHostKeyDB) {
+			t.Errorf("hash=%v: known_hosts still has db's key:\n%s", hash, kh)
+		}
+	}
+}
+
+func TestWriteKnownHostsHashedStable(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	sshArgs.knownHostsDir = filepath.Join(t.TempDir(), "state")
+	sshArgs.hashKnownHosts = true
+
+	web := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		Online:       true,
+		SSH_HostKeys: []string{testHostKeyWeb, testHostKeyRSA},
+	}
+	st := &ipnstate.Status{Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): web}}
+	f, err := writeKnownHosts(st, sshKnownHostsOptions(web))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mustReadFile(t, f)
+	if _, err := writeKnownHosts(st, sshKnownHostsOptions(web)); err != nil {
+		t.Fatal(err)
+	}
+	if second := mustReadFile(t, f); !bytes.Equal(first, second) {
+		t.Errorf("unchanged hashed known_hosts was rewritten:\n%s\nthen:\n%s", first, second)
+	}
+
+	// A new name gets a salt of its own; the rest keep theirs.
+	web.TailscaleIPs = append(web.TailscaleIPs, netaddr.MustParseIP("fd7a:115c:a1e0::1"))
+	if _, err := writeKnownHosts(st, sshKnownHostsOptions(web)); err != nil {
+		t.Fatal(err)
+	}
+	third := string(mustReadFile(t, f))
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(string(first), "\n"), "\n") {
+		if !strings.Contains(third, line) {
+			t.Errorf("after adding an IP, line %q is gone:\n%s", line, third)
+		}
+	}
+	if got, want := strings.Count(third, "\n"), strings.Count(string(first), "\n")+2; got != want {
+		t.Errorf("after adding an IP, got %d lines; want %d:\n%s", got, want, third)
+	}
+}
+
+func TestHashKnownHostsName(t *testing.T) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testHostKeyWeb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"web.foo.ts.net", "100.64.0.1", "[web]:2222"} {
+		hashed := hashKnownHostsName(host)
+		if !knownHostsHashMatches(hashed, host) || knownHostsHashMatches(hashed, host+"x") {
+			t.Errorf("%q: knownHostsHashMatches disagrees with hashKnownHostsName", host)
+		}
+		// ssh's own knownhosts package must read it as host's.
+		f := filepath.Join(t.TempDir(), "known_hosts")
+		if err := os.WriteFile(f, []byte(hashed+" "+testHostKeyWeb+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cb, err := knownhosts.New(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := host
+		if !strings.HasPrefix(addr, "[") {
+			addr = net.JoinHostPort(host, "22")
+		}
+		if err := cb(addr, &net.TCPAddr{IP: net.IPv4(100, 64, 0, 1), Port: 22}, pk); err != nil {
+			t.Errorf("%q: knownhosts rejects %q: %v", host, hashed, err)
+		}
+		// And we must match its hashing.
+		if theirs := knownhosts.HashHostname(host); !knownHostsHashMatches(theirs, host) {
+			t.Errorf("%q: knownHostsHashMatches(%q) = false; want true", host, theirs)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, f string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func knownHostsPeerNames(peers []*ipnstate.PeerStatus) []string {
+	var names []string
+	for _, ps := range peers {
+		names = append(names, knownHostsFirstName(ps))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameKnownHostsPeers(a, b []*ipnstate.PeerStatus) bool {
+	return reflect.DeepEqual(knownHostsPeerNames(a), knownHostsPeerNames(b))
+}
+
+func TestKnownHostsNonDefaultPort(t *testing.T) {
+	oldArgs := sshArgs
+	defer func() { sshArgs = oldArgs }()
+	stateDir := filepath.Join(t.TempDir(), "state")
+	sshArgs.knownHostsDir = stateDir
+
+	web := &ipnstate.PeerStatus{
+		DNSName:      "web.foo.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+		Online:       true,
+		SSH_HostKeys: []string{testHostKeyWeb},
+	}
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{testNodeKey(1): web},
+	}
+	got := knownHostsString(t, st, KnownHostsOptions{Port: 2222})
+	want := "web.foo.ts.net,web,100.64.0.1,fd7a:115c:a1e0::1," +
+		"[web.foo.ts.net]:2222,[web]:2222,[100.64.0.1]:2222,[fd7a:115c:a1e0::1]:2222 " + testHostKeyWeb + "\n"
+	if got != want {
+		t.Errorf("known_hosts:\n%s\nwant:\n%s", got, want)
+	}
+	for _, port := range []int{0, 22} {
+		if got := knownHostsString(t, st, KnownHostsOptions{Port: port}); strings.Contains(got, "[") {
+			t.Errorf("port %d: known_hosts has bracketed hosts:\n%s", port, got)
+		}
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testHostKeyWeb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []bool{false, true} {
+		sshArgs.hashKnownHosts = hash
+		sshArgs.port = 2222
+		f, err := writeKnownHosts(st, sshKnownHostsOptions(web))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filepath.Join(stateDir, "ssh_known_hosts_port2222")
+		if hash {
+			want = filepath.Join(stateDir, "ssh_known_hosts_hashed_port2222")
+		}
+		if f != want {
+			t.Errorf("hash=%v: file = %q; want %q", hash, f, want)
+		}
+		cb, err := knownhosts.New(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// As ssh, and the built-in client via net.JoinHostPort,
+		// look them up.
+		for _, addr := range []string{"100.64.0.1:2222", "[fd7a:115c:a1e0::1]:2222", "web.foo.ts.net:2222", "100.64.0.1:22"} {
+			if err := cb(addr, &net.TCPAddr{}, pub); err != nil {
+				t.Errorf("hash=%v: verifying %s: %v", hash, addr, err)
+			}
+		}
+	}
+
+	// ssh is pointed at the port's file.
+	sshArgs.hashKnownHosts = false
+	sshArgs.socket = "/tmp/tailscaled.sock"
+	argv, _, err := buildSSHArgs(context.Background(), sshBuildOptions{Status: st, Username: "alice", Host: "web", SSH: "/usr/bin/ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := firstSSHOption(argv, "UserKnownHostsFile"); v != sshQuotePath(filepath.Join(stateDir, "ssh_known_hosts_port2222")) {
+		t.Errorf("UserKnownHostsFile = %s; want the port 2222 file", v)
+	}
+	if !hasArgs(argv, "-p", "2222") {
+		t.Errorf("argv %q lacks -p 2222", argv)
+	}
+}
@@ -13,11 +13,16 @@
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
 func init() {
+	fileOwnedByOther = func(fi os.FileInfo) bool {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		return ok && int(st.Uid) != os.Getuid()
+	}
 	getSSHClientEnvVar = func() string {
 		if os.Getenv("SUDO_USER") == "" {
 			// No sudo, just check the env.
@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshUserMapEntry is an entry in the --user-map file, which is a JSON
+// array of them, as in:
+//
+//	[
+//	  {"Host": "router-*", "User": "root"},
+//	  {"Host": "web.example.ts.net", "User": "deploy"}
+//	]
+type sshUserMapEntry struct {
+	// Host is a pattern, in path.Match syntax, that's matched
+	// against the host as given on the command line, ignoring
+	// case.
+	Host string
+	// User is the name to log in as on matching hosts.
+	User string
+}
+
+// sshUserMapFile returns the path of the user map file: --user-map if
+// set, else ssh_users.json in sshStateDir. The default file needn't
+// exist.
+func sshUserMapFile() (file string, explicit bool, err error) {
+	if sshArgs.userMap != "" {
+		return sshArgs.userMap, true, nil
+	}
+	dir, err := sshStateDir()
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.Join(dir, "ssh_users.json"), false, nil
+}
+
+// sshMappedUsername returns the username that the user map file maps
+// host to, or the empty string if none does. The first matching entry
+// wins, as in ssh_config.
+func sshMappedUsername(host string) (string, error) {
+	file, explicit, err := sshUserMapFile()
+	if err != nil {
+		return "", err
+	}
+	j, err := os.ReadFile(file)
+	if os.IsNotExist(err) && !explicit {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("user map: %w", err)
+	}
+	var entries []sshUserMapEntry
+	if err := json.Unmarshal(j, &entries); err != nil {
+		return "", fmt.Errorf("user map %s: %w", file, err)
+	}
+	return matchSSHUserMap(entries, host)
+}
+
+// matchSSHUserMap returns the User of the first entry in entries whose
+// Host pattern matches host, or the empty string if none does.
+func matchSSHUserMap(entries []sshUserMapEntry, host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, e := range entries {
+		ok, err := path.Match(strings.ToLower(e.Host), host)
+		if err != nil {
+			return "", fmt.Errorf("user map: bad Host pattern %q: %w", e.Host, err)
+		}
+		if ok && e.User != "" {
+			return e.User, nil
+		}
+	}
+	return "", nil
+}
@@ -7,6 +7,7 @@
 package main // import "tailscale.com/cmd/tailscale"
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,7 +23,9 @@ func main() {
 		args = []string{"web", "-cgi"}
 	}
 	if err := cli.Run(args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		if !errors.Is(err, cli.ErrRemoteExit) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -164,6 +164,10 @@ type PeerStatus struct {
 	// SSH_HostKeys are the node's SSH host keys, if known.
 	SSH_HostKeys []string `json:"sshHostKeys,omitempty"`
 
+	// SSH_HostCAKey is the public key of the CA that signs the
+	// node's SSH host certificates, if it has any.
+	SSH_HostCAKey string `json:"sshHostCAKey,omitempty"`
+
 	// ShareeNode indicates this node exists in the netmap because
 	// it's owned by a shared-to user and that node might connect
 	// to us. These nodes should be hidden by "tailscale status"
@@ -306,6 +310,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.SSH_HostKeys; v != nil {
 		e.SSH_HostKeys = v
 	}
+	if v := st.SSH_HostCAKey; v != "" {
+		e.SSH_HostCAKey = v
+	}
 	if v := st.Addrs; v != nil {
 		e.Addrs = v
 	}